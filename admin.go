@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pendulea/pendule-archiver/engine"
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+// admin routes: read only JSON reports of the engine, served on ADMIN_ADDR
+var adminRoutes = map[string]func(r *http.Request) (interface{}, error){
+	"/missing": func(r *http.Request) (interface{}, error) {
+		return engine.Engine.ListMissingData(), nil
+	},
+	"/plan": func(r *http.Request) (interface{}, error) {
+		return engine.Engine.PlanRefresh(r.URL.Query().Get("head") != "false")
+	},
+	"/calendar": func(r *http.Request) (interface{}, error) {
+		q := r.URL.Query()
+		statuses, err := engine.ParseCalendarStatuses(q.Get("status"))
+		if err != nil {
+			return nil, err
+		}
+		return engine.Engine.Calendar(engine.CalendarQuery{
+			SetID:       strings.ToLower(q.Get("set")),
+			ArchiveType: pcommon.ArchiveType(q.Get("type")),
+			From:        q.Get("from"),
+			To:          q.Get("to"),
+			Statuses:    statuses,
+		})
+	},
+}
+
+// admin actions: POST routes changing the state of the running daemon
+var adminActions = map[string]func(r *http.Request) (interface{}, error){
+	// the tiering index lives in the daemon memory, files are rehydrated by the daemon only
+	"/rehydrate": func(r *http.Request) (interface{}, error) {
+		q := r.URL.Query()
+		return engine.Tiering.Rehydrate(strings.ToLower(q.Get("set")), q.Get("date"))
+	},
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// requestDaemon sends a request to the admin API of the running daemon, and returns its JSON answer.
+func requestDaemon(method string, path string, query url.Values) (json.RawMessage, error) {
+	if engine.Env.ADMIN_ADDR == "" {
+		return nil, fmt.Errorf("ADMIN_ADDR is not set, the daemon admin API is required")
+	}
+	host := engine.Env.ADMIN_ADDR
+	if strings.HasPrefix(host, ":") {
+		host = "localhost" + host
+	}
+	u := url.URL{Scheme: "http", Host: host, Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("daemon admin API unreachable: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		answer := map[string]string{}
+		if err := json.Unmarshal(data, &answer); err == nil && answer["error"] != "" {
+			return nil, fmt.Errorf("%s", answer["error"])
+		}
+		return nil, fmt.Errorf("daemon admin API: %s", resp.Status)
+	}
+	return json.RawMessage(data), nil
+}
+
+// runAdminServer serves the admin routes until the process exits (nothing is served if ADMIN_ADDR is empty).
+func runAdminServer() {
+	if engine.Env.ADMIN_ADDR == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	handle := func(path string, method string, handler func(r *http.Request) (interface{}, error)) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != method {
+				writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+				return
+			}
+			res, err := handler(r)
+			if err != nil {
+				writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+				return
+			}
+			writeJSON(w, http.StatusOK, res)
+		})
+	}
+	for path, handler := range adminRoutes {
+		handle(path, http.MethodGet, handler)
+	}
+	for path, handler := range adminActions {
+		handle(path, http.MethodPost, handler)
+	}
+	log.WithFields(log.Fields{
+		"addr": engine.Env.ADMIN_ADDR,
+	}).Info("Admin API listening")
+	if err := http.ListenAndServe(engine.Env.ADMIN_ADDR, mux); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Admin API stopped")
+	}
+}
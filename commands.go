@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pendulea/pendule-archiver/engine"
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+type command struct {
+	description string
+	run         func(args []string) error
+}
+
+var commands = map[string]command{
+	"retention": {
+		description: "run the raw archive retention policies (dry-run report unless -apply)",
+		run:         runRetentionCommand,
+	},
+	"calendar": {
+		description: "report the state of each day of the archives: calendar [-set id] [-type archive_type] [-from date] [-to date] [-status missing,failed,...]",
+		run:         runCalendarCommand,
+	},
+	"import": {
+		description: "import the Binance archives of a directory tree and fragment them: import [-copy] [-dry-run] <dir>",
+		run:         runImportCommand,
+	},
+	"revalidate": {
+		description: "compare the archives of the last days with the server (dry-run report unless -apply): revalidate [-days n] [-apply]",
+		run:         runRevalidateCommand,
+	},
+	"verify": {
+		description: "check the stored fragments against their manifest and raw archive: verify [-set id] [-type archive_type] [-from date] [-to date] [-requeue]",
+		run:         runVerifyCommand,
+	},
+	"missing": {
+		description: "list the archives recorded as missing on the server",
+		run:         runMissingCommand,
+	},
+	"plan": {
+		description: "print the runners a refresh would queue, without downloading nor writing anything: plan [-head=false]",
+		run:         runPlanCommand,
+	},
+	"rehydrate": {
+		description: "download back from the bucket the offloaded files of a set for a date, through the daemon admin API: rehydrate <set_id> <date>",
+		run:         runRehydrateCommand,
+	},
+}
+
+func printUsage() {
+	fmt.Println("Usage: pendule-archiver [command] [flags]")
+	fmt.Println("Without command, the archiver runs as a daemon.")
+	fmt.Println("Commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %-12s %s\n", name, commands[name].description)
+	}
+}
+
+func printJSON(v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(data))
+	return nil
+}
+
+// runCommand runs a one shot command and exits.
+func runCommand(name string, args []string) {
+	cmd, ok := commands[name]
+	if !ok {
+		printUsage()
+		os.Exit(2)
+	}
+	if err := cmd.run(args); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Errorf("%s command failed", name)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func runRetentionCommand(args []string) error {
+	fs := flag.NewFlagSet("retention", flag.ExitOnError)
+	apply := fs.Bool("apply", false, "delete/move the raw archives instead of only reporting")
+	fs.Parse(args)
+
+	if _, err := engine.Engine.LoadSets(); err != nil {
+		return err
+	}
+	if !*apply {
+		return printJSON(engine.Engine.RetentionSweep(true))
+	}
+	// the daemon sweeps and fragments the same archives, it must not run meanwhile
+	if err := engine.Engine.Start(); err != nil {
+		return err
+	}
+	report := engine.Engine.RetentionSweep(false)
+	engine.Engine.Shutdown(0)
+	return printJSON(report)
+}
+
+func runRehydrateCommand(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: rehydrate <set_id> <date>")
+	}
+	// the daemon keeps the tiering index in memory, it would overwrite the one rewritten by this process
+	restored, err := requestDaemon(http.MethodPost, "/rehydrate", url.Values{
+		"set":  {strings.ToLower(args[0])},
+		"date": {args[1]},
+	})
+	if err != nil {
+		return err
+	}
+	return printJSON(restored)
+}
+
+func runImportCommand(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	copyFiles := fs.Bool("copy", false, "copy the archives instead of moving them")
+	dryRun := fs.Bool("dry-run", false, "only report what would be imported")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: import [-copy] [-dry-run] <dir>")
+	}
+
+	if _, err := engine.Engine.LoadSets(); err != nil {
+		return err
+	}
+	mode := engine.MIRROR_MOVE
+	if *copyFiles {
+		mode = engine.MIRROR_COPY
+	}
+	if !*dryRun {
+		if err := engine.Engine.Start(); err != nil {
+			return err
+		}
+	}
+	results, err := engine.Engine.Import(fs.Arg(0), mode, *dryRun)
+	if err != nil {
+		return err
+	}
+	if !*dryRun {
+		engine.Engine.WaitIdle()
+		// persists the parser notifications that could not be delivered
+		engine.Engine.Shutdown(0)
+	}
+	return printJSON(results)
+}
+
+func runRevalidateCommand(args []string) error {
+	fs := flag.NewFlagSet("revalidate", flag.ExitOnError)
+	days := fs.Int("days", engine.Env.REVALIDATION_LOOKBACK_DAYS, "number of past days to compare")
+	apply := fs.Bool("apply", false, "fetch and fragment again the republished archives instead of only reporting")
+	fs.Parse(args)
+
+	if _, err := engine.Engine.LoadSets(); err != nil {
+		return err
+	}
+	if *apply {
+		if err := engine.Engine.Start(); err != nil {
+			return err
+		}
+	}
+	report := engine.Engine.Revalidate(*days, !*apply)
+	if *apply {
+		engine.Engine.WaitIdle()
+		// persists the parser notifications that could not be delivered
+		engine.Engine.Shutdown(0)
+	}
+	return printJSON(report)
+}
+
+func runMissingCommand(args []string) error {
+	if _, err := engine.Engine.LoadSets(); err != nil {
+		return err
+	}
+	return printJSON(engine.Engine.ListMissingData())
+}
+
+func runCalendarCommand(args []string) error {
+	fs := flag.NewFlagSet("calendar", flag.ExitOnError)
+	setID := fs.String("set", "", "only this set")
+	archiveType := fs.String("type", "", "only this archive type")
+	from := fs.String("from", "", "first date (default: first day of the history)")
+	to := fs.String("to", "", "last date (default: yesterday)")
+	status := fs.String("status", "", "only the days with these comma separated statuses")
+	fs.Parse(args)
+
+	statuses, err := engine.ParseCalendarStatuses(*status)
+	if err != nil {
+		return err
+	}
+	if _, err := engine.Engine.LoadSets(); err != nil {
+		return err
+	}
+	report, err := engine.Engine.Calendar(engine.CalendarQuery{
+		SetID:       strings.ToLower(*setID),
+		ArchiveType: pcommon.ArchiveType(*archiveType),
+		From:        *from,
+		To:          *to,
+		Statuses:    statuses,
+	})
+	if err != nil {
+		return err
+	}
+	return printJSON(report)
+}
+
+func runPlanCommand(args []string) error {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	head := fs.Bool("head", true, "estimate the download sizes with HEAD requests")
+	fs.Parse(args)
+
+	plan, err := engine.Engine.PlanRefresh(*head)
+	if err != nil {
+		return err
+	}
+	return printJSON(plan)
+}
+
+func runVerifyCommand(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	setID := fs.String("set", "", "only this set")
+	archiveType := fs.String("type", "", "only this archive type")
+	from := fs.String("from", "", "first date (default: first day of the history)")
+	to := fs.String("to", "", "last date (default: yesterday)")
+	requeue := fs.Bool("requeue", false, "fragment or download again the mismatching archives instead of only reporting")
+	fs.Parse(args)
+
+	if _, err := engine.Engine.LoadSets(); err != nil {
+		return err
+	}
+	if *requeue {
+		if err := engine.Engine.Start(); err != nil {
+			return err
+		}
+	}
+	report, err := engine.Engine.Verify(engine.VerifyQuery{
+		SetID:       strings.ToLower(*setID),
+		ArchiveType: pcommon.ArchiveType(*archiveType),
+		From:        *from,
+		To:          *to,
+		Requeue:     *requeue,
+	})
+	if err != nil {
+		return err
+	}
+	if *requeue {
+		engine.Engine.WaitIdle()
+		// persists the parser notifications that could not be delivered
+		engine.Engine.Shutdown(0)
+	}
+	return printJSON(report)
+}
@@ -1,12 +1,13 @@
 package engine
 
 import (
+	"archive/zip"
 	"encoding/csv"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
@@ -18,12 +19,25 @@ import (
 )
 
 func addArchiveFragmenterProcess(runner *gorunner.Runner) {
-	runner.AddProcess(func() error {
+	runner.AddProcess(func() (err error) {
 		date, _ := gorunner.GetArg[string](runner.Args, ARG_VALUE_DATE)
 		set, _ := gorunner.GetArg[*pcommon.SetJSON](runner.Args, ARG_VALUE_SET)
 		t, _ := gorunner.GetArg[pcommon.ArchiveType](runner.Args, ARG_VALUE_ARCHIVE_TYPE)
+		defer DiskGuard.release(runner.ID)
+		defer func() {
+			Backoff.handle(runner, RETRY_CLASS_FRAGMENT, err)
+		}()
 
 		archivePath := t.GetArchiveZipPath(date, set.Settings)
+		estimate, _ := estimateFragmenterSpace(archivePath)
+		if err := DiskGuard.admit(runner.ID, archivePath, estimate); err != nil {
+			return err
+		}
+		cleanup, err := fetchLocalFile(archivePath)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
 		stat, err := os.Stat(archivePath)
 		if err != nil {
 			return err
@@ -80,28 +94,17 @@ func addArchiveFragmenterProcess(runner *gorunner.Runner) {
 			defer os.Remove(archiveDir + ".csv")
 			defer os.RemoveAll(archiveDir)
 
-			err := pcommon.File.UnzipFile(archivePath, archiveDir)
-			if err != nil {
-				if err.Error() == "zip: not a valid zip file" {
+			if err := extractArchiveCSV(archivePath, archiveDir); err != nil {
+				if errors.Is(err, zip.ErrFormat) {
+					// corrupted archive, downloaded again on next refresh
+					Output.Delete(archivePath)
 					os.Remove(archivePath)
+					return fmt.Errorf("%w: %s", ErrInvalidArchive, err.Error())
 				}
 				return err
 			}
-			listCSVFiles, err := os.ReadDir(archiveDir)
-			if err != nil {
-				return err
-			}
-			list := lo.Filter(listCSVFiles, func(f os.DirEntry, idx int) bool {
-				return filepath.Ext(f.Name()) == ".csv"
-			})
-			if len(list) != 1 {
-				return fmt.Errorf("invalid number of csv files")
-			}
-			if err := os.Rename(filepath.Join(archiveDir, list[0].Name()), archiveDir+".csv"); err != nil {
-				return err
-			}
 		} else if archiveExt != ".csv" {
-			return fmt.Errorf("invalid extension")
+			return fmt.Errorf("%w: invalid extension", ErrInvalidArchive)
 		}
 
 		logData.step = 1
@@ -109,41 +112,17 @@ func addArchiveFragmenterProcess(runner *gorunner.Runner) {
 		if err != nil {
 			return err
 		}
+		if runner.MustInterrupt() {
+			return ErrInterrupted
+		}
 		logData.total = len(lines)
 
 		tree := pcommon.ArchivesIndex[t]
 		computedTimes := make([]string, len(lines))
-		timeTitle := strings.ToLower(tree.Time.OriginColumnTitle)
-
 		for i, line := range lines {
-			done := false
-			var err error = nil
-			if timeTitle != "" {
-				if idx, ok := headerXY[timeTitle]; ok {
-					if tree.Time.DataFilter == nil {
-						computedTimes[i] = line[idx]
-					} else {
-						computedTimes[i], err = tree.Time.DataFilter(line[idx], line, headerXY)
-					}
-					done = true
-				}
-			}
-			if !done && tree.Time.OriginColumnIndex >= 0 {
-				if tree.Time.DataFilter == nil {
-					computedTimes[i] = line[tree.Time.OriginColumnIndex]
-				} else {
-					computedTimes[i], err = tree.Time.DataFilter(line[tree.Time.OriginColumnIndex], line, headerXY)
-				}
-				done = true
-			}
-
-			if err != nil {
+			if computedTimes[i], err = branchValue(tree.Time, line, headerXY); err != nil {
 				return err
 			}
-
-			if !done {
-				return fmt.Errorf("can't find the column")
-			}
 		}
 
 		filesToRM := []string{}
@@ -153,14 +132,9 @@ func addArchiveFragmenterProcess(runner *gorunner.Runner) {
 			}
 		}
 
-		var assetJSON *pcommon.AssetJSON = nil
+		order := fragmentRowOrder(computedTimes)
+		fragments := []ManifestFragment{}
 		for _, col := range tree.Columns {
-			for _, asset := range set.Assets {
-				if asset.Address.AssetType == col.Asset {
-					assetJSON = &asset
-					break
-				}
-			}
 			logData.step = 2
 			logData.asset = col.Asset
 
@@ -182,91 +156,81 @@ func addArchiveFragmenterProcess(runner *gorunner.Runner) {
 				rmAllFiles()
 				return err
 			}
-			writer := csv.NewWriter(file)
-
-			//write header
-			if err := writer.Write([]string{string(pcommon.ColumnType.TIME), string(col.Asset)}); err != nil {
-				rmAllFiles()
-				return err
-			}
-
-			colTitle := strings.ToLower(col.OriginColumnTitle)
-
-			for idx, line := range lines {
-				logData.i = idx + 1
-				value := ""
-				found := false
-				var err error = nil
-
-				if colTitle != "" {
-					if idx, ok := headerXY[colTitle]; ok {
-						if col.DataFilter == nil {
-							value = line[idx]
-						} else {
-							value, err = col.DataFilter(line[idx], line, headerXY)
-						}
-						found = true
-					}
-				}
-				if !found && col.OriginColumnIndex >= 0 {
-					if col.DataFilter == nil {
-						value = line[col.OriginColumnIndex]
-					} else {
-						value, err = col.DataFilter(line[col.OriginColumnIndex], line, headerXY)
-					}
-					found = true
-				}
-
-				if err != nil {
-					rmAllFiles()
-					return err
-				}
-
-				if !found {
-					rmAllFiles()
-					return fmt.Errorf("can't find the column")
-				}
 
-				value = strings.TrimSpace(value)
-				if len(value) > 0 {
-					if assetJSON != nil {
-						if v, err := strconv.ParseFloat(value, 64); err == nil {
-							value = pcommon.Format.Float(v, assetJSON.Decimals)
-						}
-					}
-					if err := writer.Write([]string{strings.TrimSpace(computedTimes[idx]), value}); err != nil {
-						rmAllFiles()
-						return err
-					}
-				}
-				if idx%10000 == 0 {
-					writer.Flush()
-				}
+			fragment, err := writeFragmentCSV(file, col, findSetAsset(set, col.Asset), lines, headerXY, computedTimes, order, func(i int) bool {
+				logData.i = i + 1
+				return i%10000 == 0 && runner.MustInterrupt()
+			})
+			if cerr := file.Close(); err == nil {
+				err = cerr
 			}
-
-			writer.Flush()
-			if err := file.Close(); err != nil {
+			if err != nil {
 				rmAllFiles()
 				return err
 			}
-			if err := pcommon.File.ZipFile(csvFilePath, zipFilePath); err != nil {
+			fragment.Path = zipFilePath
+			if err := zipFragment(csvFilePath, zipFilePath); err != nil {
 				rmAllFiles()
 				return err
 			}
 
 			os.Remove(csvFilePath)
+			fragments = append(fragments, *fragment)
 			logData.step = 3
 			logPlease()
 		}
 
+		manifest, err := buildFragmentManifest(date, set, t, fragments)
+		if err != nil {
+			rmAllFiles()
+			return err
+		}
+		for i, fp := range manifest.Paths() {
+			if err := storeLocalFile(fp); err != nil {
+				for _, stored := range manifest.Paths()[:i] {
+					Output.Delete(stored)
+				}
+				rmAllFiles()
+				return err
+			}
+		}
+		if err := manifest.Write(set.Settings); err != nil {
+			rmAllFiles()
+			return err
+		}
+		if manifest.Republished != nil {
+			// the manifest keeps the mark until the parser is notified
+			os.Remove(getRepublishedPath(date, set.Settings, t))
+		}
+		// new fragments, the parser gets all the attempts again
+		if err := clearNotificationRejection(date, set.Settings.IDString(), t); err != nil {
+			log.WithFields(log.Fields{
+				"rid":   runner.ID,
+				"error": err.Error(),
+			}).Warn("Failed to remove rejected notification record")
+		}
+		go Engine.notifyFragmentsReady(manifest)
+		if isLocalStorage() {
+			if err := Tiering.OffloadFragments(manifest); err != nil {
+				log.WithFields(log.Fields{
+					"rid":   runner.ID,
+					"error": err.Error(),
+				}).Warn("Failed to offload fragments to bucket")
+			}
+		}
+		applyRetention(date, set, t, Env.RETENTION_DRY_RUN)
+
 		return nil
 	})
 }
 
+func fragmenterID(date string, set pcommon.SetSettings, t pcommon.ArchiveType) string {
+	return fmt.Sprintf("frag-%s-%s-%s", set.IDString(), date, string(t))
+}
+
 func buildArchiveFragmenter(date string, set *pcommon.SetJSON, t pcommon.ArchiveType) *gorunner.Runner {
 
-	id := fmt.Sprintf("frag-%s-%s-%s", set.Settings.IDString(), date, string(t))
-	runner := gorunner.NewRunner(id)
+	runner := gorunner.NewRunner(fragmenterID(date, set.Settings, t))
 
 	runner.AddArgs(ARG_VALUE_DATE, date)
 	runner.AddArgs(ARG_VALUE_SET, set)
@@ -294,6 +258,43 @@ func buildArchiveFragmenter(date string, set *pcommon.SetJSON, t pcommon.Archive
 	return runner
 }
 
+// extractArchiveCSV unzips a raw archive into archiveDir and moves its only csv file to archiveDir.csv
+func extractArchiveCSV(archivePath string, archiveDir string) error {
+	if err := pcommon.File.UnzipFile(archivePath, archiveDir); err != nil {
+		return err
+	}
+	listCSVFiles, err := os.ReadDir(archiveDir)
+	if err != nil {
+		return err
+	}
+	list := lo.Filter(listCSVFiles, func(f os.DirEntry, idx int) bool {
+		return filepath.Ext(f.Name()) == ".csv"
+	})
+	if len(list) != 1 {
+		return fmt.Errorf("%w: invalid number of csv files", ErrInvalidArchive)
+	}
+	return os.Rename(filepath.Join(archiveDir, list[0].Name()), archiveDir+".csv")
+}
+
+// branchValue returns the value of a branch of the archive tree for a line of the raw archive (column found by title, or else by index).
+func branchValue(b pcommon.AssetBranch, line []string, headerXY map[string]int) (string, error) {
+	if title := strings.ToLower(b.OriginColumnTitle); title != "" {
+		if idx, ok := headerXY[title]; ok {
+			if b.DataFilter == nil {
+				return line[idx], nil
+			}
+			return b.DataFilter(line[idx], line, headerXY)
+		}
+	}
+	if b.OriginColumnIndex >= 0 {
+		if b.DataFilter == nil {
+			return line[b.OriginColumnIndex], nil
+		}
+		return b.DataFilter(line[b.OriginColumnIndex], line, headerXY)
+	}
+	return "", fmt.Errorf("%w: can't find the column", ErrInvalidArchive)
+}
+
 func ParseFromCSV(fp string) ([][]string, map[string]int, error) {
 	headerCoord := map[string]int{}
 
@@ -0,0 +1,252 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fantasim/gorunner"
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// 429 answered by every mirror
+	RETRY_CLASS_RATE_LIMITED = "rate_limited"
+	// 5xx, unexpected status or size
+	RETRY_CLASS_SERVER = "server"
+	// download stalled under DOWNLOAD_MIN_RATE or idle for DOWNLOAD_IDLE_TIMEOUT
+	RETRY_CLASS_TIMEOUT = "timeout"
+	// connection errors
+	RETRY_CLASS_NETWORK = "network"
+	// downloaded archive not matching its published checksum
+	RETRY_CLASS_CHECKSUM = "checksum"
+	// fragmenter errors
+	RETRY_CLASS_FRAGMENT = "fragment"
+	// fragments rejected by the parser (see NotificationRejection)
+	RETRY_CLASS_REJECTED = "rejected"
+)
+
+// RetryPolicy is the retry schedule of an error class: the n-th retry waits Base * 2^(n-1), capped to Max, with jitter.
+type RetryPolicy struct {
+	Base time.Duration `json:"base"`
+	Max  time.Duration `json:"max"`
+	// the runner gives up after MaxAttempts failures of the class
+	MaxAttempts int `json:"max_attempts"`
+}
+
+var DEFAULT_RETRY_POLICIES = map[string]RetryPolicy{
+	RETRY_CLASS_RATE_LIMITED: {Base: time.Minute, Max: 30 * time.Minute, MaxAttempts: 10},
+	RETRY_CLASS_SERVER:       {Base: 30 * time.Second, Max: 10 * time.Minute, MaxAttempts: 5},
+	RETRY_CLASS_TIMEOUT:      {Base: 10 * time.Second, Max: 5 * time.Minute, MaxAttempts: 5},
+	RETRY_CLASS_NETWORK:      {Base: 10 * time.Second, Max: 5 * time.Minute, MaxAttempts: 5},
+	RETRY_CLASS_CHECKSUM:     {Base: time.Minute, Max: 10 * time.Minute, MaxAttempts: 3},
+	RETRY_CLASS_FRAGMENT:     {Base: 5 * time.Second, Max: time.Minute, MaxAttempts: 3},
+	RETRY_CLASS_REJECTED:     {Base: time.Minute, Max: time.Hour, MaxAttempts: 10},
+}
+
+/*
+parseRetryPolicies parses a comma separated list of <error class>=<base>:<max>:<max attempts>
+ex: server=1m:30m:8,timeout=5s:2m:10
+*/
+func parseRetryPolicies(s string) (map[string]RetryPolicy, error) {
+	policies := map[string]RetryPolicy{}
+	for class, p := range DEFAULT_RETRY_POLICIES {
+		policies[class] = p
+	}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid retry policy: %s", entry)
+		}
+		class := strings.TrimSpace(kv[0])
+		if _, ok := DEFAULT_RETRY_POLICIES[class]; !ok {
+			return nil, fmt.Errorf("unknown error class: %s", class)
+		}
+		parts := strings.Split(strings.TrimSpace(kv[1]), ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid retry policy: %s", entry)
+		}
+		base, err := time.ParseDuration(parts[0])
+		if err != nil || base <= 0 {
+			return nil, fmt.Errorf("invalid retry base delay: %s", parts[0])
+		}
+		max, err := time.ParseDuration(parts[1])
+		if err != nil || max < base {
+			return nil, fmt.Errorf("invalid retry max delay: %s", parts[1])
+		}
+		attempts, err := strconv.Atoi(parts[2])
+		if err != nil || attempts < 1 {
+			return nil, fmt.Errorf("invalid retry max attempts: %s", parts[2])
+		}
+		policies[class] = RetryPolicy{Base: base, Max: max, MaxAttempts: attempts}
+	}
+	return policies, nil
+}
+
+// delay returns the delay before the n-th retry (n >= 1): half of the exponential delay is fixed, the other half is random.
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := p.Max
+	if n <= 30 {
+		if exp := p.Base << (n - 1); exp > 0 && exp < p.Max {
+			d = exp
+		}
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+type backoffState struct {
+	attempts map[string]int
+}
+
+/*
+retryBackoff delays the retries of each runner according to the policy of its error class.
+A runner in backoff is held out of the engine queue (see Held), so it does not take a slot nor stall the other runners.
+*/
+type retryBackoff struct {
+	states map[string]*backoffState
+	mu     sync.Mutex
+}
+
+var Backoff = &retryBackoff{
+	states: make(map[string]*backoffState),
+}
+
+/*
+handle is deferred by the runner processes, every error they return goes through it:
+  - interrupted runners are not retried (engine shutting down or set not active anymore),
+    nor the downloaders of recent archives not published yet
+  - runners short of disk space wait for the disk guard
+  - runners of a throttled host wait for the host to be unblocked
+  - other errors are retried according to the policy of their class, or given up if not retryable
+*/
+func (b *retryBackoff) handle(runner *gorunner.Runner, class string, err error) {
+	switch {
+	case err == nil:
+		b.forget(runner)
+		DiskGuard.forget(runner.ID)
+	case errors.Is(err, ErrInterrupted), errors.Is(err, ErrNotPublished):
+	case errors.Is(err, ErrInsufficientDiskSpace):
+		DiskGuard.hold(runner)
+	case errors.Is(err, ErrHostThrottled):
+		RateLimiter.hold(runner)
+	case !isRetryable(err):
+		b.giveUp(runner, err)
+	default:
+		b.onError(runner, class, err)
+	}
+}
+
+// onError holds the runner until its next attempt, or gives up once the class max attempts is reached.
+func (b *retryBackoff) onError(runner *gorunner.Runner, class string, err error) {
+	policy, ok := Env.RETRY_POLICIES[class]
+	if !ok {
+		policy = DEFAULT_RETRY_POLICIES[class]
+	}
+
+	b.mu.Lock()
+	state, ok := b.states[runner.ID]
+	if !ok {
+		state = &backoffState{attempts: map[string]int{}}
+		b.states[runner.ID] = state
+	}
+	state.attempts[class]++
+	attempts := state.attempts[class]
+	delay := policy.delay(attempts)
+	if attempts >= policy.MaxAttempts {
+		delete(b.states, runner.ID)
+	}
+	b.mu.Unlock()
+	saveRunnerFailure(runner, &RunnerFailure{
+		Error:    err.Error(),
+		Class:    class,
+		Attempts: attempts,
+		At:       time.Now().UnixMilli(),
+		GaveUp:   attempts >= policy.MaxAttempts,
+	})
+
+	fields := log.Fields{
+		"rid":      runner.ID,
+		"class":    class,
+		"attempts": attempts,
+		"error":    err.Error(),
+	}
+	if attempts >= policy.MaxAttempts {
+		log.WithFields(fields).Error("Giving up after too many failures")
+		return
+	}
+	Held.holdFor(runner, delay)
+	Engine.persistState()
+	fields["retry_in"] = pcommon.Format.AccurateHumanize(delay)
+	log.WithFields(fields).Warn("Retrying later")
+}
+
+// giveUp records the failure of a runner failing with an error that is not retryable, it is not held for a retry.
+func (b *retryBackoff) giveUp(runner *gorunner.Runner, err error) {
+	b.mu.Lock()
+	delete(b.states, runner.ID)
+	b.mu.Unlock()
+	saveRunnerFailure(runner, &RunnerFailure{
+		Error:  err.Error(),
+		At:     time.Now().UnixMilli(),
+		GaveUp: true,
+	})
+}
+
+// forget clears the failures of a runner (called on success).
+func (b *retryBackoff) forget(runner *gorunner.Runner) {
+	b.mu.Lock()
+	delete(b.states, runner.ID)
+	b.mu.Unlock()
+	saveRunnerFailure(runner, nil)
+}
+
+// attempts returns the failures of the runners by ID and error class, to persist them.
+func (b *retryBackoff) attempts() map[string]map[string]int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	attempts := make(map[string]map[string]int, len(b.states))
+	for id, state := range b.states {
+		attempts[id] = make(map[string]int, len(state.attempts))
+		for class, n := range state.attempts {
+			attempts[id][class] = n
+		}
+	}
+	return attempts
+}
+
+// restore reloads the failures persisted by the previous process, so a restart does not reset the max attempts.
+func (b *retryBackoff) restore(attempts map[string]map[string]int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, classes := range attempts {
+		state := &backoffState{attempts: map[string]int{}}
+		for class, n := range classes {
+			state.attempts[class] = n
+		}
+		b.states[id] = state
+	}
+}
+
+// classifyDownloadError returns the retry class of a downloader error.
+func classifyDownloadError(err error) string {
+	switch {
+	case errors.Is(err, ErrTooManyRequests):
+		return RETRY_CLASS_RATE_LIMITED
+	case errors.Is(err, ErrChecksumMismatch), errors.Is(err, ErrUnverified):
+		return RETRY_CLASS_CHECKSUM
+	case errors.Is(err, ErrFailedDownload), errors.Is(err, ErrInvalidFileSize):
+		return RETRY_CLASS_SERVER
+	case errors.Is(err, ErrStalled):
+		return RETRY_CLASS_TIMEOUT
+	}
+	return RETRY_CLASS_NETWORK
+}
@@ -0,0 +1,98 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+func TestParseRetryPolicies(t *testing.T) {
+	policies, err := parseRetryPolicies("server=1m:30m:8, timeout=5s:2m:10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := policies[RETRY_CLASS_SERVER]; p != (RetryPolicy{Base: time.Minute, Max: 30 * time.Minute, MaxAttempts: 8}) {
+		t.Fatalf("server policy %+v", p)
+	}
+	if p := policies[RETRY_CLASS_TIMEOUT]; p != (RetryPolicy{Base: 5 * time.Second, Max: 2 * time.Minute, MaxAttempts: 10}) {
+		t.Fatalf("timeout policy %+v", p)
+	}
+	// the other classes keep their default
+	if policies[RETRY_CLASS_NETWORK] != DEFAULT_RETRY_POLICIES[RETRY_CLASS_NETWORK] || len(policies) != len(DEFAULT_RETRY_POLICIES) {
+		t.Fatalf("default policies not kept: %+v", policies)
+	}
+	if DEFAULT_RETRY_POLICIES[RETRY_CLASS_SERVER].MaxAttempts != 5 {
+		t.Fatal("default policies modified")
+	}
+
+	for _, invalid := range []string{
+		"server",
+		"unknown=1m:30m:8",
+		"server=1m:30m",
+		"server=fast:30m:8",
+		"server=0s:30m:8",
+		"server=1m:30s:8",
+		"server=1m:30m:0",
+	} {
+		if _, err := parseRetryPolicies(invalid); err == nil {
+			t.Errorf("invalid retry policy %q parsed", invalid)
+		}
+	}
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := RetryPolicy{Base: 10 * time.Second, Max: 5 * time.Minute, MaxAttempts: 5}
+	for n, exp := range map[int]time.Duration{
+		1:  10 * time.Second,
+		2:  20 * time.Second,
+		4:  80 * time.Second,
+		6:  5 * time.Minute,
+		64: 5 * time.Minute,
+	} {
+		// half of the delay is fixed, the other half is random
+		for i := 0; i < 100; i++ {
+			if d := p.delay(n); d < exp/2 || d > exp {
+				t.Fatalf("retry %d waits %s, out of [%s, %s]", n, d, exp/2, exp)
+			}
+		}
+	}
+}
+
+func TestBackoffGivesUp(t *testing.T) {
+	pcommon.Env.ARCHIVES_DIR = t.TempDir()
+	previous := Env.RETRY_POLICIES
+	Env.RETRY_POLICIES = map[string]RetryPolicy{RETRY_CLASS_SERVER: {Base: time.Hour, Max: time.Hour, MaxAttempts: 2}}
+	t.Cleanup(func() { Env.RETRY_POLICIES = previous })
+
+	set := testSet(time.Minute, 3)
+	date := "2024-01-15"
+	runner := buildArchiveDownloader(date, &set, pcommon.BINANCE_SPOT_TRADES)
+	t.Cleanup(func() {
+		Held.drop(map[string]interface{}{ARG_VALUE_SET: &set})
+		Backoff.forget(runner)
+	})
+
+	// held until its next attempt
+	Backoff.handle(runner, RETRY_CLASS_SERVER, ErrFailedDownload)
+	if Held.count() != 1 {
+		t.Fatal("failed runner not held for a retry")
+	}
+	f, _ := ReadRunnerFailure(date, set.Settings, pcommon.BINANCE_SPOT_TRADES, runner.ID)
+	if f == nil || f.Attempts != 1 || f.GaveUp {
+		t.Fatalf("first failure %+v", f)
+	}
+
+	Held.drop(map[string]interface{}{ARG_VALUE_SET: &set})
+	Backoff.handle(runner, RETRY_CLASS_SERVER, ErrFailedDownload)
+	if Held.count() != 0 {
+		t.Fatal("runner held after its max attempts")
+	}
+	f, _ = ReadRunnerFailure(date, set.Settings, pcommon.BINANCE_SPOT_TRADES, runner.ID)
+	if f == nil || f.Attempts != 2 || !f.GaveUp {
+		t.Fatalf("last failure %+v", f)
+	}
+	if len(Backoff.attempts()[runner.ID]) != 0 {
+		t.Fatal("attempts kept after giving up")
+	}
+}
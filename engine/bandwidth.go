@@ -0,0 +1,266 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+const BANDWIDTH_CONFIG_WATCH_INTERVAL = 5 * time.Second
+
+// a download waits at most BANDWIDTH_MAX_SLEEP at once, to check for its interruption
+const BANDWIDTH_MAX_SLEEP = 200 * time.Millisecond
+
+// bandwidthWindow caps the global bandwidth between From and To (minutes since midnight, local time, To may be before From).
+type bandwidthWindow struct {
+	From  int
+	To    int
+	Limit int64
+}
+
+func (w bandwidthWindow) contains(t time.Time) bool {
+	m := t.Hour()*60 + t.Minute()
+	if w.From <= w.To {
+		return m >= w.From && m < w.To
+	}
+	return m >= w.From || m < w.To
+}
+
+// bandwidthConfig limits are in bytes per second, 0 is unlimited.
+type bandwidthConfig struct {
+	Limit    int64
+	PerHost  map[string]int64
+	Schedule []bandwidthWindow
+}
+
+// limit returns the global limit at t: the one of the first schedule window containing t, or Limit.
+func (c bandwidthConfig) limit(t time.Time) int64 {
+	for _, w := range c.Schedule {
+		if w.contains(t) {
+			return w.Limit
+		}
+	}
+	return c.Limit
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+/*
+parseBandwidthSchedule parses a comma separated list of <HH:MM>-<HH:MM>=<limit per second>
+ex: 08:00-19:00=5mb,19:00-08:00=0 (0 is unlimited)
+*/
+func parseBandwidthSchedule(s string) ([]bandwidthWindow, error) {
+	schedule := []bandwidthWindow{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		bounds := strings.SplitN(kv[0], "-", 2)
+		if len(kv) != 2 || len(bounds) != 2 {
+			return nil, fmt.Errorf("invalid bandwidth window: %s", entry)
+		}
+		from, err := parseClock(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseClock(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		limit, err := parseByteSize(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, bandwidthWindow{From: from, To: to, Limit: limit})
+	}
+	return schedule, nil
+}
+
+/*
+parseHostBandwidthLimits parses a comma separated list of <host>=<limit per second>
+ex: data.binance.vision=5mb,cache.internal=0
+*/
+func parseHostBandwidthLimits(s string) (map[string]int64, error) {
+	limits := map[string]int64{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid host bandwidth limit: %s", entry)
+		}
+		limit, err := parseByteSize(kv[1])
+		if err != nil {
+			return nil, err
+		}
+		limits[strings.TrimSpace(kv[0])] = limit
+	}
+	return limits, nil
+}
+
+// bandwidthFileContent is the JSON config file reloaded at runtime, with the syntax of the env variables.
+type bandwidthFileContent struct {
+	Limit    string `json:"limit"`
+	PerHost  string `json:"per_host"`
+	Schedule string `json:"schedule"`
+}
+
+func readBandwidthConfigFile(path string) (*bandwidthConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	content := bandwidthFileContent{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("invalid bandwidth file %s: %s", path, err.Error())
+	}
+	config := &bandwidthConfig{PerHost: map[string]int64{}, Schedule: []bandwidthWindow{}}
+	if content.Limit != "" {
+		if config.Limit, err = parseByteSize(content.Limit); err != nil {
+			return nil, err
+		}
+	}
+	if config.PerHost, err = parseHostBandwidthLimits(content.PerHost); err != nil {
+		return nil, err
+	}
+	if config.Schedule, err = parseBandwidthSchedule(content.Schedule); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// bandwidthBucket is a token bucket of bytes. Tokens can go negative: a read larger than the bucket is paid by waiting afterwards.
+type bandwidthBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *bandwidthBucket) take(n int, limit int64, now time.Time) time.Duration {
+	if limit <= 0 {
+		b.tokens = 0
+		b.last = now
+		return 0
+	}
+	b.tokens += now.Sub(b.last).Seconds() * float64(limit)
+	if b.tokens > float64(limit) {
+		// at most one second of burst
+		b.tokens = float64(limit)
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(limit) * float64(time.Second))
+}
+
+// bandwidthLimiter caps the download reads globally and per host.
+type bandwidthLimiter struct {
+	config bandwidthConfig
+	global bandwidthBucket
+	hosts  map[string]*bandwidthBucket
+	mu     sync.Mutex
+}
+
+var Bandwidth = &bandwidthLimiter{
+	hosts: make(map[string]*bandwidthBucket),
+}
+
+func (l *bandwidthLimiter) setConfig(config bandwidthConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = config
+}
+
+// take consumes n bytes of the global and host buckets, and returns how long the read must wait.
+func (l *bandwidthLimiter) take(host string, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	wait := l.global.take(n, l.config.limit(now), now)
+	if limit, ok := l.config.PerHost[host]; ok {
+		b, ok := l.hosts[host]
+		if !ok {
+			b = &bandwidthBucket{last: now}
+			l.hosts[host] = b
+		}
+		if w := b.take(n, limit, now); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// reader returns r with its reads throttled to the bandwidth limits of the host of rawURL, onThrottle is called with each wait.
+func (l *bandwidthLimiter) reader(rawURL string, r io.Reader, interruptionCheck func() bool, onThrottle func(wait time.Duration)) io.Reader {
+	return &throttledReader{r: r, host: urlHost(rawURL), interruptionCheck: interruptionCheck, onThrottle: onThrottle}
+}
+
+type throttledReader struct {
+	r                 io.Reader
+	host              string
+	interruptionCheck func() bool
+	onThrottle        func(wait time.Duration)
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if n > 0 {
+		wait := Bandwidth.take(t.host, n)
+		for wait > 0 && !t.interruptionCheck() {
+			d := wait
+			if d > BANDWIDTH_MAX_SLEEP {
+				d = BANDWIDTH_MAX_SLEEP
+			}
+			time.Sleep(d)
+			t.onThrottle(d)
+			wait -= d
+		}
+	}
+	return n, err
+}
+
+// RunConfigWatcher reloads BANDWIDTH_CONFIG_FILE each time it is modified (its limits replace the env ones).
+func (l *bandwidthLimiter) RunConfigWatcher() {
+	path := Env.BANDWIDTH_CONFIG_FILE
+	if path == "" {
+		return
+	}
+	lastModTime := time.Time{}
+	for !Engine.IsShuttingDown() {
+		if stat, err := os.Stat(path); err == nil && !stat.ModTime().Equal(lastModTime) {
+			lastModTime = stat.ModTime()
+			config, err := readBandwidthConfigFile(path)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err.Error(),
+				}).Error("Error reading bandwidth config file")
+			} else {
+				l.setConfig(*config)
+				log.WithFields(log.Fields{
+					"limit":    pcommon.Format.LargeBytesToShortString(config.Limit) + "/s",
+					"hosts":    len(config.PerHost),
+					"schedule": len(config.Schedule),
+				}).Info("Bandwidth limits reloaded")
+			}
+		}
+		time.Sleep(BANDWIDTH_CONFIG_WATCH_INTERVAL)
+	}
+}
@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBandwidthSchedule(t *testing.T) {
+	schedule, err := parseBandwidthSchedule("08:00-19:00=5mb, 22:30-06:00=1mb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(schedule) != 2 || schedule[0] != (bandwidthWindow{From: 8 * 60, To: 19 * 60, Limit: 5_000_000}) {
+		t.Fatalf("parsed schedule %+v", schedule)
+	}
+	config := bandwidthConfig{Limit: 10_000_000, Schedule: schedule}
+
+	day := time.Date(2024, 1, 15, 0, 0, 0, 0, time.Local)
+	for clock, limit := range map[string]int64{
+		"08:00": 5_000_000,
+		"18:59": 5_000_000,
+		"19:00": 10_000_000,
+		// the second window wraps around midnight
+		"22:30": 1_000_000,
+		"23:59": 1_000_000,
+		"00:00": 1_000_000,
+		"05:59": 1_000_000,
+		"06:00": 10_000_000,
+	} {
+		minutes, _ := parseClock(clock)
+		if l := config.limit(day.Add(time.Duration(minutes) * time.Minute)); l != limit {
+			t.Errorf("limit at %s is %d instead of %d", clock, l, limit)
+		}
+	}
+
+	for _, invalid := range []string{"08:00=5mb", "08:00-19:00", "8h-19h=5mb", "08:00-19:00=fast"} {
+		if _, err := parseBandwidthSchedule(invalid); err == nil {
+			t.Errorf("invalid schedule %q parsed", invalid)
+		}
+	}
+}
+
+func TestBandwidthBucketTake(t *testing.T) {
+	now := time.Now()
+	b := &bandwidthBucket{last: now}
+
+	// empty bucket: 500 bytes at 1000 B/s wait half a second
+	if wait := b.take(500, 1000, now); wait != 500*time.Millisecond {
+		t.Fatalf("waited %s instead of 500ms", wait)
+	}
+	// refilled by the wait
+	if wait := b.take(500, 1000, now.Add(time.Second)); wait != 0 {
+		t.Fatalf("waited %s with refilled tokens", wait)
+	}
+	// at most one second of burst after an idle period
+	if wait := b.take(1500, 1000, now.Add(time.Hour)); wait != 500*time.Millisecond {
+		t.Fatalf("waited %s instead of 500ms after a burst", wait)
+	}
+	// unlimited: no wait and no debt kept for later
+	if wait := b.take(1_000_000, 0, now.Add(time.Hour)); wait != 0 {
+		t.Fatalf("waited %s without limit", wait)
+	}
+	if wait := b.take(1000, 1000, now.Add(time.Hour+time.Second)); wait != 0 {
+		t.Fatalf("waited %s for the bytes read without limit", wait)
+	}
+}
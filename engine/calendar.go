@@ -0,0 +1,220 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+type CalendarStatus string
+
+const (
+	// the fragments of all the targeted assets are stored
+	CALENDAR_FRAGMENTED CalendarStatus = "fragmented"
+	// the raw archive is stored, not fragmented yet
+	CALENDAR_DOWNLOADED CalendarStatus = "downloaded"
+	// the server does not publish the archive (see MissingData)
+	CALENDAR_MISSING CalendarStatus = "missing"
+	// the downloader or the fragmenter gave up
+	CALENDAR_FAILED CalendarStatus = "failed"
+	// scheduled by the refresh (after the consistency of the set), not downloaded yet or being retried
+	CALENDAR_PENDING CalendarStatus = "pending"
+	// nothing stored before the end of the consistency (ingested then cleaned up, or never archived)
+	CALENDAR_ABSENT CalendarStatus = "absent"
+)
+
+var CALENDAR_STATUSES = []CalendarStatus{CALENDAR_FRAGMENTED, CALENDAR_DOWNLOADED, CALENDAR_MISSING, CALENDAR_FAILED, CALENDAR_PENDING, CALENDAR_ABSENT}
+
+type CalendarDay struct {
+	Date   string         `json:"date"`
+	Status CalendarStatus `json:"status"`
+	// last error of the downloader or the fragmenter
+	Error string `json:"error,omitempty"`
+}
+
+type ArchiveCalendar struct {
+	SetID       string                 `json:"set_id"`
+	ArchiveType pcommon.ArchiveType    `json:"archive_type"`
+	From        string                 `json:"from"`
+	To          string                 `json:"to"`
+	Counts      map[CalendarStatus]int `json:"counts"`
+	Days        []CalendarDay          `json:"days"`
+}
+
+// CalendarQuery filters the calendar report, empty fields are not filtered.
+type CalendarQuery struct {
+	SetID       string
+	ArchiveType pcommon.ArchiveType
+	// by default, from the first day of the history of the set until yesterday
+	From     string
+	To       string
+	Statuses []CalendarStatus
+}
+
+/*
+ParseCalendarStatuses parses a comma separated list of statuses
+ex: missing,failed
+*/
+func ParseCalendarStatuses(s string) ([]CalendarStatus, error) {
+	statuses := []CalendarStatus{}
+	for _, entry := range strings.Split(s, ",") {
+		status := CalendarStatus(strings.TrimSpace(entry))
+		if status == "" {
+			continue
+		}
+		known := false
+		for _, st := range CALENDAR_STATUSES {
+			known = known || st == status
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown calendar status: %s", status)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// historyStart returns the first day of the history of the assets of a set built from an archive type, "" if there is none.
+func historyStart(set *pcommon.SetJSON, t pcommon.ArchiveType, minTimeframe time.Duration) string {
+	start := ""
+	for _, asset := range set.Assets {
+		required := asset.Address.AssetType.GetRequiredArchiveType()
+		if len(asset.Address.Dependencies) > 0 || required == nil || *required != t {
+			continue
+		}
+		c := asset.FindConsistencyByTimeframe(minTimeframe)
+		if c == nil {
+			continue
+		}
+		date := pcommon.Format.FormatDateStr(c.Range[0].ToTime())
+		if start == "" || strings.Compare(date, start) < 0 {
+			start = date
+		}
+	}
+	return start
+}
+
+// archiveDayStatus derives the status of the archive of a date from the stored files, the missing data records and the runner failures.
+func archiveDayStatus(date string, set *pcommon.SetJSON, t pcommon.ArchiveType, scheduled bool) CalendarDay {
+	day := CalendarDay{Date: date}
+
+	fragmented := true
+	if _, err := os.Stat(getManifestPath(date, set.Settings, t)); err != nil {
+		// fragmented before the manifests were written, or not fragmented
+		for _, asset := range t.GetTargetedAssets() {
+			if !fileExists(set.Settings.BuildArchiveFilePath(asset, date, "zip")) {
+				fragmented = false
+				break
+			}
+		}
+	}
+	if fragmented {
+		day.Status = CALENDAR_FRAGMENTED
+		return day
+	}
+
+	if missing, _ := ReadMissingData(date, set.Settings, t); missing != nil {
+		day.Status = CALENDAR_MISSING
+		return day
+	}
+
+	downloaded := fileExists(t.GetArchiveZipPath(date, set.Settings))
+	runnerID := fragmenterID(date, set.Settings, t)
+	if !downloaded {
+		runnerID = downloaderID(date, set.Settings, t)
+	}
+	failure, _ := ReadRunnerFailure(date, set.Settings, t, runnerID)
+	if failure != nil {
+		day.Error = failure.Error
+		if failure.GaveUp {
+			day.Status = CALENDAR_FAILED
+			return day
+		}
+	}
+
+	switch {
+	case downloaded:
+		day.Status = CALENDAR_DOWNLOADED
+	case scheduled:
+		day.Status = CALENDAR_PENDING
+	default:
+		day.Status = CALENDAR_ABSENT
+	}
+	return day
+}
+
+/*
+Calendar reports the state of each day of the archives of the active sets:
+the days the refresh schedules (see scheduledArchives) are pending until downloaded, the others are derived from the stored files.
+*/
+func (e *engine) Calendar(q CalendarQuery) ([]ArchiveCalendar, error) {
+	for _, date := range []string{q.From, q.To} {
+		if date == "" {
+			continue
+		}
+		if _, err := pcommon.Format.StrDateToDate(date); err != nil {
+			return nil, fmt.Errorf("invalid date: %s", date)
+		}
+	}
+	keep := map[CalendarStatus]bool{}
+	for _, status := range q.Statuses {
+		keep[status] = true
+	}
+
+	e.mu.RLock()
+	minTimeframe := e.minTimeframe
+	sets := make([]*pcommon.SetJSON, 0, len(e.activeSets))
+	for _, set := range e.activeSets {
+		if q.SetID == "" || set.Settings.IDString() == q.SetID {
+			sets = append(sets, set)
+		}
+	}
+	e.mu.RUnlock()
+
+	report := []ArchiveCalendar{}
+	for _, set := range sets {
+		scheduled := map[string]bool{}
+		for _, v := range scheduledArchives(set, minTimeframe) {
+			scheduled[v[0]+v[1]] = true
+		}
+
+		for _, t := range pcommon.ARCHIVE_TYPE_LIST {
+			if (q.ArchiveType != "" && t != q.ArchiveType) || !setUsesArchiveType(set, t) {
+				continue
+			}
+			from, to := q.From, q.To
+			if from == "" {
+				from = historyStart(set, t, minTimeframe)
+			}
+			if to == "" {
+				to = pcommon.Format.BuildDateStr(1)
+			}
+			if from == "" {
+				continue
+			}
+
+			calendar := ArchiveCalendar{
+				SetID:       set.Settings.IDString(),
+				ArchiveType: t,
+				From:        from,
+				To:          to,
+				Counts:      map[CalendarStatus]int{},
+				Days:        []CalendarDay{},
+			}
+			start, _ := pcommon.Format.StrDateToDate(from)
+			for d := start; strings.Compare(pcommon.Format.FormatDateStr(d), to) <= 0; d = d.AddDate(0, 0, 1) {
+				date := pcommon.Format.FormatDateStr(d)
+				day := archiveDayStatus(date, set, t, scheduled[string(t)+date])
+				calendar.Counts[day.Status]++
+				if len(keep) == 0 || keep[day.Status] {
+					calendar.Days = append(calendar.Days, day)
+				}
+			}
+			report = append(report, calendar)
+		}
+	}
+	return report, nil
+}
@@ -1,3 +1,9 @@
 package engine
 
-const MAX_RETRY_PER_DOWLOAD_FAILED = 3
+import "time"
+
+// the engine never retries a failed runner by itself: the runner is held and added back by the backoff (see backoff.go)
+const MAX_RETRY_PER_RUNNER = 0
+
+const SET_POLLING_INTERVAL = time.Minute
+const SET_POLLING_INTERVAL_WATCHED = 15 * time.Minute
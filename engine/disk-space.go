@@ -0,0 +1,247 @@
+package engine
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fantasim/gorunner"
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+const DISK_SPACE_CHECK_INTERVAL = 30 * time.Second
+const DISK_SPACE_LOG_INTERVAL = time.Minute
+
+type diskReservation struct {
+	path string
+	size int64
+}
+
+/*
+diskGuard defers the runners that would not fit on disk and pauses the engine below the low watermark.
+Reservations of running runners are all subtracted from the free space, even if they are on another volume.
+A runner is admitted when its process starts: a deferred runner fails with ErrInsufficientDiskSpace and is held
+out of the queue until the next check finds the engine is not paused.
+*/
+type diskGuard struct {
+	reservations  map[string]diskReservation
+	expectedSizes map[string]int64
+	watchedPaths  map[string]bool
+	lastLogs      map[string]time.Time
+	held          map[string]bool
+	paused        atomic.Bool
+	mu            sync.Mutex
+}
+
+var DiskGuard = &diskGuard{
+	reservations:  make(map[string]diskReservation),
+	expectedSizes: make(map[string]int64),
+	watchedPaths:  make(map[string]bool),
+	lastLogs:      make(map[string]time.Time),
+	held:          make(map[string]bool),
+}
+
+// freeDiskSpace returns the space available on the volume of path (or of its closest existing parent).
+func freeDiskSpace(path string) (int64, error) {
+	p := path
+	for {
+		if _, err := os.Stat(p); err == nil {
+			break
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			break
+		}
+		p = parent
+	}
+	return statfsAvailable(p)
+}
+
+func (g *diskGuard) IsPaused() bool {
+	return g.paused.Load()
+}
+
+func (g *diskGuard) logOnce(key string, fields log.Fields, msg string) {
+	if last, ok := g.lastLogs[key]; ok && time.Since(last) < DISK_SPACE_LOG_INTERVAL {
+		return
+	}
+	g.lastLogs[key] = time.Now()
+	log.WithFields(fields).Warn(msg)
+}
+
+func (g *diskGuard) unsafeReservedExcept(runnerID string) int64 {
+	var total int64 = 0
+	for id, r := range g.reservations {
+		if id != runnerID {
+			total += r.size
+		}
+	}
+	return total
+}
+
+// unsafeFits checks size bytes can be written on path volume while keeping the low watermark free.
+func (g *diskGuard) unsafeFits(runnerID string, path string, size int64) (bool, log.Fields) {
+	g.watchedPaths[filepath.Dir(path)] = true
+	free, err := freeDiskSpace(path)
+	if err != nil {
+		// statfs unavailable, not blocking
+		return true, nil
+	}
+	available := free - g.unsafeReservedExcept(runnerID) - Env.DISK_LOW_WATERMARK
+	if size > available {
+		return false, log.Fields{
+			"runner":    runnerID,
+			"needed":    pcommon.Format.LargeBytesToShortString(size),
+			"free":      pcommon.Format.LargeBytesToShortString(free),
+			"reserved":  pcommon.Format.LargeBytesToShortString(g.unsafeReservedExcept(runnerID)),
+			"watermark": pcommon.Format.LargeBytesToShortString(Env.DISK_LOW_WATERMARK),
+			"dir":       filepath.Dir(path),
+		}
+	}
+	return true, nil
+}
+
+// admit is called when a runner process starts: it fails if the engine is paused or if the runner would not fit on disk,
+// otherwise reserves the estimated space until release is called.
+func (g *diskGuard) admit(runnerID string, path string, estimate int64) error {
+	if g.IsPaused() {
+		return ErrInsufficientDiskSpace
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if estimate <= 0 {
+		estimate = g.expectedSizes[runnerID]
+	}
+	ok, fields := g.unsafeFits(runnerID, path, estimate)
+	if !ok {
+		g.logOnce(runnerID, fields, "Not enough disk space, deferring runner")
+		return ErrInsufficientDiskSpace
+	}
+	g.reservations[runnerID] = diskReservation{path: path, size: estimate}
+	return nil
+}
+
+// hold keeps a runner short of disk space out of the queue until the next check.
+func (g *diskGuard) hold(runner *gorunner.Runner) {
+	g.mu.Lock()
+	g.held[runner.ID] = true
+	g.mu.Unlock()
+	Held.hold(runner)
+}
+
+// releaseHeld adds back the held runners, they are admitted (or held again) when their process starts.
+func (g *diskGuard) releaseHeld() {
+	g.mu.Lock()
+	ids := make([]string, 0, len(g.held))
+	for id := range g.held {
+		ids = append(ids, id)
+	}
+	g.held = make(map[string]bool)
+	g.mu.Unlock()
+
+	for _, id := range ids {
+		Held.release(id)
+	}
+}
+
+// reserve replaces the runner reservation once its exact size is known, and fails if it does not fit.
+func (g *diskGuard) reserve(runnerID string, path string, size int64) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.expectedSizes[runnerID] = size
+	ok, fields := g.unsafeFits(runnerID, path, size)
+	if !ok {
+		g.logOnce(runnerID, fields, "Not enough disk space, deferring runner")
+		delete(g.reservations, runnerID)
+		return ErrInsufficientDiskSpace
+	}
+	g.reservations[runnerID] = diskReservation{path: path, size: size}
+	return nil
+}
+
+func (g *diskGuard) release(runnerID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.reservations, runnerID)
+}
+
+// forget drops the known size of a runner once it succeeded.
+func (g *diskGuard) forget(runnerID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.expectedSizes, runnerID)
+	delete(g.lastLogs, runnerID)
+}
+
+func (g *diskGuard) check() {
+	g.mu.Lock()
+	paths := []string{pcommon.Env.ARCHIVES_DIR}
+	for p := range g.watchedPaths {
+		paths = append(paths, p)
+	}
+	g.mu.Unlock()
+
+	for _, p := range paths {
+		free, err := freeDiskSpace(p)
+		if err != nil {
+			continue
+		}
+		if free < Env.DISK_LOW_WATERMARK {
+			if !g.paused.Swap(true) {
+				log.WithFields(log.Fields{
+					"free":      pcommon.Format.LargeBytesToShortString(free),
+					"watermark": pcommon.Format.LargeBytesToShortString(Env.DISK_LOW_WATERMARK),
+					"dir":       p,
+				}).Warn("Disk space below low watermark, pausing the engine")
+			}
+			return
+		}
+	}
+	if g.paused.Swap(false) {
+		log.Info("Disk space back above low watermark, resuming the engine")
+	}
+	g.releaseHeld()
+}
+
+// Run checks the free space of the watched volumes every DISK_SPACE_CHECK_INTERVAL.
+func (g *diskGuard) Run() {
+	for {
+		g.check()
+		time.Sleep(DISK_SPACE_CHECK_INTERVAL)
+	}
+}
+
+// estimateFragmenterSpace returns the scratch space needed to fragment an archive:
+// the extracted csv, the per asset csv being built (at most the size of the extracted one) and the zipped fragments.
+func estimateFragmenterSpace(archivePath string) (int64, error) {
+	stat, err := os.Stat(archivePath)
+	if err != nil {
+		// not on local disk yet: it will be fetched from the output storage, csv archives compress ~10x
+		o, serr := Output.Stat(archivePath)
+		if serr != nil || isLocalStorage() {
+			return 0, err
+		}
+		return o.Size * 11, nil
+	}
+	if filepath.Ext(archivePath) != ".zip" {
+		return stat.Size() * 2, nil
+	}
+
+	r, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	var uncompressed int64 = 0
+	for _, f := range r.File {
+		uncompressed += int64(f.UncompressedSize64)
+	}
+	return uncompressed*2 + stat.Size(), nil
+}
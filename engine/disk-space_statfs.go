@@ -0,0 +1,13 @@
+//go:build !windows
+
+package engine
+
+import "syscall"
+
+func statfsAvailable(path string) (int64, error) {
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
@@ -0,0 +1,8 @@
+package engine
+
+import "errors"
+
+// statfs is not available on windows, the disk guard never blocks.
+func statfsAvailable(path string) (int64, error) {
+	return 0, errors.New("statfs not supported")
+}
@@ -0,0 +1,325 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+// base URL of the archive URLs built by pcommon (ArchiveType.GetURL)
+const BINANCE_DATA_BASE_URL = "https://data.binance.vision"
+
+const MIRROR_DOWN_MIN_INTERVAL = 30 * time.Second
+const MIRROR_DOWN_MAX_INTERVAL = 10 * time.Minute
+
+/*
+parseDownloadMirrors parses a comma separated, prioritized list of [<archive_type>=]<base url>
+ex: http://cache.internal/binance,binance_book_depth=http://depth-cache.internal
+Mirrors without archive type are used for all archive types.
+*/
+func parseDownloadMirrors(s string) (map[pcommon.ArchiveType][]string, []string, error) {
+	perType := map[pcommon.ArchiveType][]string{}
+	global := []string{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		base := entry
+		var t pcommon.ArchiveType = ""
+		if kv := strings.SplitN(entry, "=", 2); len(kv) == 2 && !strings.Contains(kv[0], "/") {
+			t = pcommon.ArchiveType(strings.TrimSpace(kv[0]))
+			if _, ok := pcommon.ArchivesIndex[t]; !ok {
+				return nil, nil, fmt.Errorf("unknown archive type: %s", t)
+			}
+			base = strings.TrimSpace(kv[1])
+		}
+		if !strings.HasPrefix(base, "http://") && !strings.HasPrefix(base, "https://") {
+			return nil, nil, fmt.Errorf("invalid mirror url: %s", base)
+		}
+		base = strings.TrimRight(base, "/")
+		if t == "" {
+			global = append(global, base)
+		} else {
+			perType[t] = append(perType[t], base)
+		}
+	}
+	return perType, global, nil
+}
+
+type mirrorHealth struct {
+	failures  int
+	downUntil time.Time
+	lastError string
+}
+
+// downloadMirrors tracks the health of the download mirrors, a failing mirror is skipped for an increasing interval.
+type downloadMirrors struct {
+	health map[string]*mirrorHealth
+	mu     sync.Mutex
+}
+
+var Mirrors = &downloadMirrors{
+	health: make(map[string]*mirrorHealth),
+}
+
+// candidateURLs returns the URLs of an archive in priority order: per archive type mirrors, global mirrors, then the official URL.
+func (m *downloadMirrors) candidateURLs(t pcommon.ArchiveType, url string) []string {
+	if !strings.HasPrefix(url, BINANCE_DATA_BASE_URL) {
+		return []string{url}
+	}
+	path := strings.TrimPrefix(url, BINANCE_DATA_BASE_URL)
+	bases := append(append([]string{}, Env.DOWNLOAD_MIRRORS[t]...), Env.DOWNLOAD_MIRRORS_GLOBAL...)
+
+	urls := []string{}
+	for _, base := range bases {
+		if base != BINANCE_DATA_BASE_URL {
+			urls = append(urls, base+path)
+		}
+	}
+	return append(urls, url)
+}
+
+func mirrorBase(url string) string {
+	if i := strings.Index(url, "/data/"); i > 0 {
+		return url[:i]
+	}
+	return url
+}
+
+/*
+orderByHealth puts the mirrors that are down at the end (in the order they recover),
+so they are only tried when all the healthy ones failed.
+*/
+func (m *downloadMirrors) orderByHealth(urls []string) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	up := []string{}
+	down := []string{}
+	downUntil := func(url string) time.Time {
+		if h, ok := m.health[mirrorBase(url)]; ok {
+			return h.downUntil
+		}
+		return time.Time{}
+	}
+	for _, url := range urls {
+		// hosts throttled by the rate limiter are tried last as well
+		if downUntil(url).After(now) || RateLimiter.IsBlocked(url) {
+			down = append(down, url)
+		} else {
+			up = append(up, url)
+		}
+	}
+	for i := 1; i < len(down); i++ {
+		for j := i; j > 0 && downUntil(down[j]).Before(downUntil(down[j-1])); j-- {
+			down[j], down[j-1] = down[j-1], down[j]
+		}
+	}
+	return append(up, down...)
+}
+
+func (m *downloadMirrors) markFailure(url string, err error) {
+	base := mirrorBase(url)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.health[base]
+	if !ok {
+		h = &mirrorHealth{}
+		m.health[base] = h
+	}
+	h.failures++
+	h.lastError = err.Error()
+	interval := MIRROR_DOWN_MIN_INTERVAL << (h.failures - 1)
+	if interval > MIRROR_DOWN_MAX_INTERVAL || interval <= 0 {
+		interval = MIRROR_DOWN_MAX_INTERVAL
+	}
+	h.downUntil = time.Now().Add(interval)
+	log.WithFields(log.Fields{
+		"mirror":   base,
+		"failures": h.failures,
+		"for":      interval.String(),
+		"error":    h.lastError,
+	}).Warn("Download mirror marked down")
+}
+
+func (m *downloadMirrors) markSuccess(url string) {
+	base := mirrorBase(url)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if h, ok := m.health[base]; ok {
+		delete(m.health, base)
+		log.WithFields(log.Fields{
+			"mirror":   base,
+			"failures": h.failures,
+		}).Info("Download mirror back up")
+	}
+}
+
+// fetchChecksum returns the sha256 of the <url>.CHECKSUM file published next to each archive, "" if there is none.
+func fetchChecksum(url string) (string, error) {
+	if RateLimiter.IsBlocked(url) {
+		return "", fmt.Errorf("%w: %s", ErrHostThrottled, url)
+	}
+	if err := RateLimiter.wait(url, func() bool { return false }); err != nil {
+		return "", err
+	}
+	resp, err := downloadClient.Get(url + ".CHECKSUM")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("checksum request status: %s", resp.Status)
+	}
+	scanner := bufio.NewScanner(resp.Body)
+	if scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+/*
+verifyDownload checks a downloaded archive against the checksum published by the official source
+(falling back to the other candidates if it is unreachable), so that mirrors serving a different content are detected.
+If no candidate publishes a checksum the archive is accepted, but if some could not be reached it returns an ErrUnverified.
+*/
+func verifyDownload(fp string, urls []string) error {
+	ordered := append([]string{urls[len(urls)-1]}, urls[:len(urls)-1]...)
+	var fetchErr error = nil
+	for _, url := range ordered {
+		expected, err := fetchChecksum(url)
+		if err != nil {
+			fetchErr = err
+			continue
+		}
+		if expected == "" {
+			continue
+		}
+		f, err := hashFile(fp)
+		if err != nil {
+			return err
+		}
+		if f.SHA256 != expected {
+			return fmt.Errorf("%w (%s != %s)", ErrChecksumMismatch, f.SHA256, expected)
+		}
+		return nil
+	}
+	if fetchErr != nil {
+		log.WithFields(log.Fields{
+			"file":  fp,
+			"error": fetchErr.Error(),
+		}).Warn("Could not fetch the checksum of downloaded archive")
+		return fmt.Errorf("%w: %s (%s)", ErrUnverified, fp, fetchErr.Error())
+	}
+	return nil
+}
+
+/*
+verifyUnverifiedDownload verifies again an archive downloaded while its checksum could not be fetched, and moves it to outputFP
+if it matches. The archive is deleted on a mismatch. It returns the preflight of its mirror, nil if the mirror does not support HEAD requests.
+*/
+func verifyUnverifiedDownload(outputFP string, urls []string) (*RemoteArchive, error) {
+	unverifiedFP := outputFP + ".unverified"
+	if err := verifyDownload(unverifiedFP, urls); err != nil {
+		if errors.Is(err, ErrChecksumMismatch) {
+			os.Remove(unverifiedFP)
+			os.Remove(outputFP + ".part.json")
+		}
+		return nil, err
+	}
+	remote, err := readRemoteArchive(outputFP + ".part.json")
+	if err != nil {
+		return nil, err
+	}
+	if remote != nil && remote.Size <= 0 && remote.ETag == "" && remote.LastModified == 0 {
+		// recorded without preflight
+		remote = nil
+	}
+	if err := os.Rename(unverifiedFP, outputFP); err != nil {
+		return nil, err
+	}
+	os.Remove(outputFP + ".part.json")
+	return remote, nil
+}
+
+// isFailoverError returns true if the download should be tried again on the next mirror.
+func isFailoverError(err error) bool {
+	return !errors.Is(err, ErrInterrupted) && !errors.Is(err, ErrInsufficientDiskSpace) && !errors.Is(err, ErrUnverified)
+}
+
+/*
+downloadWithFailover downloads the archive from the first mirror that serves it with the right checksum,
+and returns what the mirror told about it in its preflight (nil if it does not support HEAD requests).
+A 404 from every mirror returns an ErrFileNotFound, otherwise the error of the last tried mirror is returned.
+An archive whose checksum can't be fetched is kept as <output>.unverified and verified again on the next call.
+*/
+func downloadWithFailover(t pcommon.ArchiveType, url string, outputFP string, interruptionCheck func() bool, statusChange func(current int64, total int64), reserveSpace func(size int64) error) (*RemoteArchive, error) {
+	urls := Mirrors.candidateURLs(t, url)
+	unverifiedFP := outputFP + ".unverified"
+	if _, err := os.Stat(unverifiedFP); err == nil {
+		if remote, err := verifyUnverifiedDownload(outputFP, urls); err == nil || !errors.Is(err, ErrChecksumMismatch) {
+			return remote, err
+		}
+	}
+
+	// the first 404 is only kept if no mirror failed otherwise
+	var lastErr error = nil
+	for i, u := range Mirrors.orderByHealth(urls) {
+		remote, err := preflight(u, interruptionCheck)
+		if err == nil {
+			err = preparePartialDownload(outputFP, u, remote)
+			if err == nil && remote != nil && remote.Size > 0 {
+				// deferred by the disk guard before anything is downloaded
+				err = reserveSpace(remote.Size)
+			}
+		}
+		if err == nil {
+			err = downloadFile(u, outputFP, remote, interruptionCheck, statusChange, reserveSpace)
+		}
+		if err == nil {
+			if err = verifyDownload(outputFP, urls); errors.Is(err, ErrUnverified) {
+				// kept apart, so it is neither fragmented nor skipped as downloaded until it is verified
+				if rerr := os.Rename(outputFP, unverifiedFP); rerr != nil {
+					return nil, rerr
+				}
+			} else if err != nil {
+				os.Remove(outputFP)
+			}
+		}
+		if err == nil {
+			os.Remove(outputFP + ".part.json")
+			Mirrors.markSuccess(u)
+			return remote, nil
+		}
+		if !isFailoverError(err) {
+			return nil, err
+		}
+		if !errors.Is(err, ErrFileNotFound) {
+			lastErr = err
+			Mirrors.markFailure(u, err)
+		} else if lastErr == nil {
+			lastErr = err
+		}
+		if i < len(urls)-1 {
+			log.WithFields(log.Fields{
+				"url":   u,
+				"error": err.Error(),
+			}).Warn("Download failed, trying next mirror")
+		}
+	}
+	return nil, lastErr
+}
@@ -0,0 +1,231 @@
+package engine
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+const testArchivePath = "/data/spot/daily/trades/BTCUSDT/BTCUSDT-trades-2024-01-15.zip"
+
+// archiveHost serves an archive and its .CHECKSUM file, or answers status to every archive request if set.
+type archiveHost struct {
+	content        []byte
+	checksum       string
+	status         int
+	checksumStatus int
+	downloads      int
+	mu             sync.Mutex
+}
+
+func (h *archiveHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if strings.HasSuffix(r.URL.Path, ".CHECKSUM") {
+		switch {
+		case h.checksumStatus != 0:
+			w.WriteHeader(h.checksumStatus)
+		case h.checksum == "":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			fmt.Fprintf(w, "%s  BTCUSDT-trades-2024-01-15.zip\n", h.checksum)
+		}
+		return
+	}
+	if h.status != 0 {
+		w.WriteHeader(h.status)
+		return
+	}
+	if r.Method == http.MethodGet {
+		h.downloads++
+	}
+	http.ServeContent(w, r, "archive.zip", time.Time{}, bytes.NewReader(h.content))
+}
+
+func (h *archiveHost) set(fn func(h *archiveHost)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fn(h)
+}
+
+// officialTransport sends the requests of data.binance.vision to a test server.
+type officialTransport struct {
+	official *url.URL
+}
+
+func (t officialTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == strings.TrimPrefix(BINANCE_DATA_BASE_URL, "https://") {
+		req = req.Clone(req.Context())
+		req.URL.Scheme, req.URL.Host, req.Host = t.official.Scheme, t.official.Host, ""
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+// useTestMirrors serves the official archives with official and sets the servers of mirrors as global mirrors, it returns their base URLs.
+func useTestMirrors(t *testing.T, official *archiveHost, mirrors ...*archiveHost) []string {
+	t.Helper()
+	officialServer := httptest.NewServer(official)
+	t.Cleanup(officialServer.Close)
+	officialURL, _ := url.Parse(officialServer.URL)
+
+	bases := []string{}
+	for _, m := range mirrors {
+		server := httptest.NewServer(m)
+		t.Cleanup(server.Close)
+		bases = append(bases, server.URL)
+	}
+	previousClient, previousMirrors := downloadClient, Env.DOWNLOAD_MIRRORS_GLOBAL
+	downloadClient = &http.Client{Transport: officialTransport{official: officialURL}}
+	Env.DOWNLOAD_MIRRORS_GLOBAL = bases
+	t.Cleanup(func() {
+		downloadClient, Env.DOWNLOAD_MIRRORS_GLOBAL = previousClient, previousMirrors
+		for _, base := range append(bases, BINANCE_DATA_BASE_URL) {
+			Mirrors.markSuccess(base + testArchivePath)
+		}
+	})
+	return bases
+}
+
+func testArchive() ([]byte, string) {
+	content := []byte("PK archive content")
+	sum := sha256.Sum256(content)
+	return content, hex.EncodeToString(sum[:])
+}
+
+func TestOrderByHealth(t *testing.T) {
+	urls := []string{"http://a.test" + testArchivePath, "http://b.test" + testArchivePath, "http://c.test" + testArchivePath, BINANCE_DATA_BASE_URL + testArchivePath}
+	defer func() {
+		for _, u := range urls {
+			Mirrors.markSuccess(u)
+		}
+	}()
+
+	Mirrors.markFailure(urls[0], errors.New("down"))
+	Mirrors.markFailure(urls[1], errors.New("down"))
+	Mirrors.markFailure(urls[1], errors.New("down again"))
+	// b is down twice as long as a: a recovers first
+	ordered := Mirrors.orderByHealth(urls)
+	if strings.Join(ordered, ",") != strings.Join([]string{urls[2], urls[3], urls[0], urls[1]}, ",") {
+		t.Fatalf("mirrors ordered %v", ordered)
+	}
+
+	Mirrors.markSuccess(urls[0])
+	if ordered := Mirrors.orderByHealth(urls); ordered[0] != urls[0] || ordered[3] != urls[1] {
+		t.Fatalf("recovered mirror not tried first: %v", ordered)
+	}
+}
+
+func TestVerifyDownload(t *testing.T) {
+	content, sum := testArchive()
+	official := &archiveHost{content: content, checksum: sum}
+	mirror := &archiveHost{content: content}
+	bases := useTestMirrors(t, official, mirror)
+	urls := []string{bases[0] + testArchivePath, BINANCE_DATA_BASE_URL + testArchivePath}
+
+	fp := filepath.Join(t.TempDir(), "archive.zip")
+	writeTestFile(t, fp, string(content))
+	if err := verifyDownload(fp, urls); err != nil {
+		t.Fatalf("archive matching the official checksum: %v", err)
+	}
+
+	writeTestFile(t, fp, "PK other content")
+	if err := verifyDownload(fp, urls); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatalf("archive not matching the official checksum: %v", err)
+	}
+
+	// the official checksum is unreachable and the mirror publishes none
+	official.set(func(h *archiveHost) { h.checksumStatus = http.StatusInternalServerError })
+	if err := verifyDownload(fp, urls); !errors.Is(err, ErrUnverified) {
+		t.Fatalf("archive without reachable checksum: %v", err)
+	}
+
+	// no candidate publishes a checksum
+	official.set(func(h *archiveHost) { h.checksumStatus, h.checksum = 0, "" })
+	if err := verifyDownload(fp, urls); err != nil {
+		t.Fatalf("archive without published checksum: %v", err)
+	}
+}
+
+func TestDownloadWithFailover(t *testing.T) {
+	content, sum := testArchive()
+	official := &archiveHost{content: content, checksum: sum}
+	broken := &archiveHost{status: http.StatusBadGateway}
+	corrupted := &archiveHost{content: []byte("PK corrupted content")}
+	healthy := &archiveHost{content: content}
+	bases := useTestMirrors(t, official, broken, corrupted, healthy)
+
+	out := filepath.Join(t.TempDir(), "archive.zip")
+	remote, err := downloadWithFailover(pcommon.BINANCE_SPOT_TRADES, BINANCE_DATA_BASE_URL+testArchivePath, out, noInterruption, noStatus, noReservation)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote == nil || remote.URL != bases[2]+testArchivePath {
+		t.Fatalf("archive downloaded from %+v instead of the healthy mirror", remote)
+	}
+	if data, _ := os.ReadFile(out); !bytes.Equal(data, content) {
+		t.Fatal("downloaded archive differs")
+	}
+	// the failing mirrors are tried last next time
+	ordered := Mirrors.orderByHealth(Mirrors.candidateURLs(pcommon.BINANCE_SPOT_TRADES, BINANCE_DATA_BASE_URL+testArchivePath))
+	if ordered[0] != bases[2]+testArchivePath || ordered[1] != BINANCE_DATA_BASE_URL+testArchivePath {
+		t.Fatalf("mirrors ordered %v after the failover", ordered)
+	}
+}
+
+func TestDownloadUnverified(t *testing.T) {
+	content, sum := testArchive()
+	official := &archiveHost{content: content, checksum: sum, checksumStatus: http.StatusServiceUnavailable}
+	mirror := &archiveHost{content: content}
+	useTestMirrors(t, official, mirror)
+
+	out := filepath.Join(t.TempDir(), "archive.zip")
+	download := func() error {
+		_, err := downloadWithFailover(pcommon.BINANCE_SPOT_TRADES, BINANCE_DATA_BASE_URL+testArchivePath, out, noInterruption, noStatus, noReservation)
+		return err
+	}
+
+	// the checksum can't be fetched: the archive is kept apart
+	if err := download(); !errors.Is(err, ErrUnverified) {
+		t.Fatalf("download without reachable checksum: %v", err)
+	}
+	if fileExists(out) || !fileExists(out+".unverified") {
+		t.Fatal("unverified archive not kept apart")
+	}
+
+	// verified on the next attempt without being downloaded again
+	official.set(func(h *archiveHost) { h.checksumStatus = 0 })
+	if err := download(); err != nil {
+		t.Fatal(err)
+	}
+	if !fileExists(out) || fileExists(out+".unverified") || fileExists(out+".part.json") {
+		t.Fatal("verified archive not moved to its path")
+	}
+	downloads := 0
+	mirror.set(func(h *archiveHost) { downloads = h.downloads })
+	if downloads != 1 {
+		t.Fatalf("archive downloaded %d times instead of once", downloads)
+	}
+
+	// an unverified archive not matching the checksum is downloaded again
+	os.Remove(out)
+	writeTestFile(t, out+".unverified", "PK corrupted content")
+	if err := download(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(out); !bytes.Equal(data, content) || fileExists(out+".unverified") {
+		t.Fatal("mismatching unverified archive not downloaded again")
+	}
+}
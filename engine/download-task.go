@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/fantasim/gorunner"
@@ -22,190 +23,249 @@ const (
 	ARG_VALUE_ARCHIVE_TYPE = "archive_type"
 )
 
-const MIN_DOWNLOAD_BYTES_PER_SECOND = 10 * 1024
 const TIMEBREAK_AFTER_TOO_MANY_REQUESTS = 2 * time.Minute
-const TIMEBREAK_UNKNOWN_REQUEST_ERROR = 30 * time.Second
 
-const FILE_NOT_FOUND_ERROR = "file not found"
-const TOO_MANY_REQUESTS_ERROR = "too many requests"
-const FAILED_DOWNLOAD_ERROR = "failed to download file"
-const INVALID_FILE_SIZE_ERROR = "invalid file size"
-const INTERRUPTED_ERROR = "interrupted"
+// sendDownloadRequest sends a GET request of url once the host rate limiter allows it, with a Range header if rangeHeader is set.
+func sendDownloadRequest(ctx context.Context, url string, rangeHeader string, interruptionCheck func() bool) (*http.Response, error) {
+	if err := RateLimiter.wait(url, interruptionCheck); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if rangeHeader != "" {
+		req.Header.Set("Range", rangeHeader)
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return nil, newNetworkError(url, err)
+	}
+	return resp, nil
+}
+
+// failedResponseError returns the error of an unexpected response, and throttles its host if it asks to slow down.
+func failedResponseError(url string, resp *http.Response) error {
+	httpErr := newHTTPError(url, resp)
+	if errors.Is(httpErr, ErrTooManyRequests) || (resp.StatusCode == http.StatusServiceUnavailable && httpErr.RetryAfter > 0) {
+		RateLimiter.throttle(url, httpErr.RetryAfter)
+	}
+	return httpErr
+}
+
+/*
+readBody copies the response body to out, throttled by the bandwidth caps and watched by a stall detector:
+the request is canceled (with cancel) as soon as the download stalls or is interrupted, even while blocked in a read.
+writeFailed is true if the error comes from out.
+*/
+func readBody(url string, resp *http.Response, out io.Writer, cancel func(), interruptionCheck func() bool, onProgress func(n int)) (writeFailed bool, err error) {
+	var stalled, interrupted atomic.Bool
+	detector := newStallDetector(Env.DOWNLOAD_STALL_WINDOW, Env.DOWNLOAD_MIN_RATE, Env.DOWNLOAD_IDLE_TIMEOUT)
+	stopWatch := detector.watch(interruptionCheck, func() {
+		stalled.Store(true)
+		cancel()
+	}, func() {
+		interrupted.Store(true)
+		cancel()
+	})
+	defer stopWatch()
+
+	// Create a buffer to write the download in chunks
+	buf := make([]byte, 1024*32) // 32KB buffer
+	body := Bandwidth.reader(url, resp.Body, interruptionCheck, detector.throttled)
+
+	for {
+		n, readErr := body.Read(buf)
+		if interrupted.Load() || interruptionCheck() {
+			return false, ErrInterrupted
+		}
+		if stalled.Load() {
+			return false, ErrStalled
+		}
+
+		if n > 0 {
+			detector.progress(n)
+			written, writeErr := out.Write(buf[:n])
+			onProgress(written)
+			if writeErr != nil {
+				return true, writeErr
+			}
+		}
+		if readErr == io.EOF {
+			return false, nil // End of file reached
+		}
+		if readErr != nil {
+			return false, newNetworkError(url, readErr)
+		}
+	}
+}
 
-func downloadFile(url string, outputFilePath string, interruptionCheck func() bool, statusChange func(current int64, total int64)) error {
+// downloadFile downloads url into outputFilePath. Data is written to a ".part" file first: on interruption
+// it is kept so the next call resumes the download with a Range request.
+// Large files are downloaded in concurrent segments (see planSegments) if the preflight remote (nil if unknown) allows it.
+// reserveSpace is called with the remaining size before writing, the download is aborted if it fails.
+func downloadFile(url string, outputFilePath string, remote *RemoteArchive, interruptionCheck func() bool, statusChange func(current int64, total int64), reserveSpace func(size int64) error) error {
 	if _, err := os.Stat(outputFilePath); err == nil {
 		return nil
 	}
 
-	client := &http.Client{}
+	partFilePath := outputFilePath + ".part"
+	var offset int64 = 0
+	if stat, err := os.Stat(partFilePath); err == nil {
+		offset = stat.Size()
+	} else if ranges := planSegments(url, outputFilePath, remote); ranges != nil {
+		return downloadSegmented(url, outputFilePath, ranges, remote.Size, interruptionCheck, statusChange, reserveSpace)
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 	abort := func() {
-		fmt.Printf("Aborting download of %s\n", url)
-		cancel()
-		os.Remove(outputFilePath)
+		log.WithFields(log.Fields{
+			"url": url,
+		}).Warn("Aborting download")
+		os.Remove(partFilePath)
 	}
-
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
-	if err != nil {
-		return err
+	checkpoint := func() {
+		log.WithFields(log.Fields{
+			"url": url,
+		}).Info("Interrupting download (partial file kept)")
 	}
 
-	resp, err := client.Do(req)
+	rangeHeader := ""
+	if offset > 0 {
+		rangeHeader = fmt.Sprintf("bytes=%d-", offset)
+	}
+	resp, err := sendDownloadRequest(ctx, url, rangeHeader, interruptionCheck)
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusTooManyRequests {
-		return fmt.Errorf(TOO_MANY_REQUESTS_ERROR)
-	}
-	if resp.StatusCode == http.StatusNotFound {
-		return fmt.Errorf(FILE_NOT_FOUND_ERROR)
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		abort()
+		return newHTTPError(url, resp)
 	}
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf(FAILED_DOWNLOAD_ERROR+" status: %s", resp.Status)
+	if resp.StatusCode == http.StatusOK {
+		// range ignored by the server, restarting from scratch
+		offset = 0
+	} else if resp.StatusCode != http.StatusPartialContent || offset == 0 {
+		return failedResponseError(url, resp)
 	}
 
-	fileSize := resp.ContentLength
-	if fileSize <= 0 {
-		return errors.New(INVALID_FILE_SIZE_ERROR)
-	}
+	RateLimiter.success(url)
 
-	var currentSize int64 = 0
-	statusChange(0, fileSize)
-
-	timedout := new(bool)
-	*timedout = false
+	if resp.ContentLength <= 0 {
+		return ErrInvalidFileSize
+	}
+	fileSize := offset + resp.ContentLength
 
-	//anto cancel request detection after 10kb per second
-	go func(fileSize int64, timedout *bool) {
-		maxWait := time.Duration(fileSize/(MIN_DOWNLOAD_BYTES_PER_SECOND))*time.Second + time.Second*3
-		time.Sleep(maxWait)
-		*timedout = true
-	}(fileSize, timedout)
+	currentSize := offset
+	statusChange(currentSize, fileSize)
 
-	defer resp.Body.Close()
+	if err := reserveSpace(resp.ContentLength); err != nil {
+		return err
+	}
 
-	outFile, err := os.Create(outputFilePath)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	outFile, err := os.OpenFile(partFilePath, flags, 0644)
 	if err != nil {
 		return err
 	}
 	defer outFile.Close()
 
-	// Create a buffer to write the download in chunks
-	buf := make([]byte, 1024*32) // 32KB buffer
-
-	for {
-		n, readErr := resp.Body.Read(buf)
-		if interruptionCheck() || *timedout {
+	writeFailed, err := readBody(url, resp, outFile, cancel, interruptionCheck, func(n int) {
+		currentSize += int64(n)
+		statusChange(currentSize, fileSize)
+	})
+	if err != nil {
+		if writeFailed {
+			outFile.Close()
 			abort()
-			return errors.New(INTERRUPTED_ERROR)
+		} else {
+			checkpoint()
 		}
+		return err
+	}
 
-		if n > 0 {
-			written, writeErr := outFile.Write(buf[:n])
-			currentSize += int64(written)
-			statusChange(currentSize, fileSize)
-			if writeErr != nil {
-				abort()
-				return writeErr
-			}
-		}
-		if readErr == io.EOF {
-			break // End of file reached
-		}
-		if readErr != nil {
-			abort()
-			return readErr
+	if currentSize != fileSize {
+		outFile.Close()
+		abort()
+		return ErrInvalidFileSize
+	}
+	if err := outFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(partFilePath, outputFilePath)
+}
+
+// downloadSkipReason returns why the archive of a date must not be downloaded, "" if it must.
+func downloadSkipReason(date string, set *pcommon.SetJSON, t pcommon.ArchiveType) (string, error) {
+	//check if file already exist
+	if fileExists(t.GetArchiveZipPath(date, set.Settings)) {
+		return "archive exists", nil
+	}
+
+	//check if all fragmented archives are built
+	list := t.GetTargetedAssets()
+	foundCount := 0
+	for _, asset := range list {
+		archiveZipPath := set.Settings.BuildArchiveFilePath(asset, date, "zip")
+		if fileExists(archiveZipPath) {
+			foundCount++
 		}
 	}
-	return nil
+	if foundCount == len(list) {
+		return "fragmented", nil
+	}
+
+	//check if the archive is recorded as missing on the server (probed again by the missing data loop)
+	missing, err := ReadMissingData(date, set.Settings, t)
+	if err != nil {
+		return "", err
+	}
+	if missing != nil {
+		return "missing on the server", nil
+	}
+	return "", nil
 }
 
 func addArchiveDownloaderProcess(runner *gorunner.Runner) {
-	runner.AddProcess(func() error {
+	runner.AddProcess(func() (err error) {
 		date, _ := gorunner.GetArg[string](runner.Args, ARG_VALUE_DATE)
 		set, _ := gorunner.GetArg[*pcommon.SetJSON](runner.Args, ARG_VALUE_SET)
 		t, _ := gorunner.GetArg[pcommon.ArchiveType](runner.Args, ARG_VALUE_ARCHIVE_TYPE)
+		defer DiskGuard.release(runner.ID)
+		defer func() {
+			Backoff.handle(runner, classifyDownloadError(err), err)
+		}()
 
 		outputFP := t.GetArchiveZipPath(date, set.Settings)
-		//check if file already exist
-		if _, err := os.Stat(outputFP); err == nil {
-			return nil
-		}
-
-		//check if all fragmented archives are built
-		list := t.GetTargetedAssets()
-		foundCount := 0
-		for _, asset := range list {
-			archiveZipPath := set.Settings.BuildArchiveFilePath(asset, date, "zip")
-			if _, err := os.Stat(archiveZipPath); err == nil {
-				foundCount++
-			}
+		if reason, err := downloadSkipReason(date, set, t); reason != "" || err != nil {
+			return err
 		}
-		if foundCount == len(list) {
-			return nil
+		if err := DiskGuard.admit(runner.ID, outputFP, 0); err != nil {
+			return err
 		}
 
 		if err := pcommon.File.EnsureDir(filepath.Dir(outputFP)); err != nil {
 			return err
 		}
 
-		if t == pcommon.BINANCE_SPOT_TRADES {
-			symbol := strings.ToUpper(set.Settings.ID[0] + set.Settings.ID[1])
-			filename := fmt.Sprintf("%s-trades-%s.zip", symbol, date)
-			path := filepath.Join(os.Getenv("ARCHIVES_DIR"), symbol, "_spot", filename)
-
-			if _, err := os.Stat(path); err == nil {
-				if err := os.Rename(path, outputFP); err != nil {
-					return err
-				}
-				os.Remove(path)
-				return nil
-			}
-		}
-
-		if t == pcommon.BINANCE_FUTURES_TRADES {
-			symbol := strings.ToUpper(set.Settings.ID[0] + set.Settings.ID[1])
-			filename := fmt.Sprintf("%s-trades-%s.zip", symbol, date)
-			path := filepath.Join(os.Getenv("ARCHIVES_DIR"), symbol, "_futures", filename)
-			if _, err := os.Stat(path); err == nil {
-				if err := os.Rename(path, outputFP); err != nil {
-					return err
-				}
-				os.Remove(path)
-				return nil
-			}
-		}
-
-		if t == pcommon.BINANCE_BOOK_DEPTH {
-			symbol := strings.ToUpper(set.Settings.ID[0] + set.Settings.ID[1])
-			filename := fmt.Sprintf("%s-bookDepth-%s.zip", symbol, date)
-			path := filepath.Join(os.Getenv("ARCHIVES_DIR"), symbol, "book_depth", filename)
-			if _, err := os.Stat(path); err == nil {
-				if err := os.Rename(path, outputFP); err != nil {
-					return err
-				}
-				os.Remove(path)
-				return nil
-			}
-		}
-		if t == pcommon.BINANCE_METRICS {
-			symbol := strings.ToUpper(set.Settings.ID[0] + set.Settings.ID[1])
-			filename := fmt.Sprintf("%s-metrics-%s.zip", symbol, date)
-			path := filepath.Join(os.Getenv("ARCHIVES_DIR"), symbol, "metrics", filename)
-			if _, err := os.Stat(path); err == nil {
-				if err := os.Rename(path, outputFP); err != nil {
-					return err
-				}
-				os.Remove(path)
-				return nil
-			}
+		//check if the archive has been pre-downloaded in the local mirror
+		if imported, err := importFromMirror(date, set.Settings, t, outputFP); imported || err != nil {
+			return err
 		}
 
 		url, err := t.GetURL(date, set.Settings)
 		if err != nil {
 			return err
 		}
+		if host := RateLimiter.blockedHost(t, url); host != "" {
+			return fmt.Errorf("%w: %s", ErrHostThrottled, host)
+		}
 
 		lastLogs := make(map[pcommon.ArchiveType]int64)
 		printProgressLog := func(t pcommon.ArchiveType, current int64, total int64, startedAt time.Time) {
@@ -243,13 +303,16 @@ func addArchiveDownloaderProcess(runner *gorunner.Runner) {
 
 		handleDownloadError := func(perfectURL string, t pcommon.ArchiveType, err error) error {
 
-			checkRouteIsValid := func() bool {
-				resp, err := http.Head(perfectURL) // Perform a HEAD request
+			checkRouteIsValid := func() (bool, MissingProbe) {
+				if err := RateLimiter.wait(perfectURL, runner.MustInterrupt); err != nil {
+					return false, newMissingProbe(perfectURL, err)
+				}
+				resp, err := downloadClient.Head(perfectURL) // Perform a HEAD request
 				if err != nil {
-					return false
+					return false, newMissingProbe(perfectURL, err)
 				}
 				resp.Body.Close() // Ensure we close the response body
-				return resp.StatusCode == 200
+				return resp.StatusCode == 200, MissingProbe{URL: perfectURL, StatusCode: resp.StatusCode}
 			}
 
 			if err != nil {
@@ -259,47 +322,32 @@ func addArchiveDownloaderProcess(runner *gorunner.Runner) {
 					return err
 				}
 
-				if strings.Contains(err.Error(), TOO_MANY_REQUESTS_ERROR) {
-					Engine.Pause(TIMEBREAK_AFTER_TOO_MANY_REQUESTS)
-				}
-				if strings.Contains(err.Error(), FILE_NOT_FOUND_ERROR) {
+				if errors.Is(err, ErrFileNotFound) {
 					xxDaysAgo := pcommon.Format.BuildDateStr(archiveIndex.ConsistencyMaxLookbackDays + 7)
 					if strings.Compare(xxDaysAgo, date) <= 0 {
-						runner.DisableRetry()
-						return err
-					} else if checkRouteIsValid() {
-						ext := filepath.Ext(outputFP)
-						fp := outputFP
-						if ext != ".csv" {
-							fp = strings.Replace(outputFP, ext, ".csv", 1)
+						return fmt.Errorf("%w: %s", ErrNotPublished, err)
+					} else if valid, probe := checkRouteIsValid(); valid {
+						probes := []MissingProbe{}
+						var httpErr *HTTPError
+						if errors.As(err, &httpErr) {
+							probes = append(probes, newMissingProbe(httpErr.URL, httpErr))
 						}
-						f, err := os.Create(fp)
-						if err != nil {
+						probes = append(probes, probe)
+						if err := Engine.recordMissingData(date, set, t, "not found while the first day of the history is published", probes); err != nil {
 							return err
 						}
-						f.Close()
-						if ext == ".zip" {
-							if err := pcommon.File.ZipFile(fp, outputFP); err != nil {
-								return err
-							}
-							os.Remove(fp)
-						}
-
-						fmt.Printf("File not found for %s (%s), but empty zip archive created as replacement.\n", t, date)
-						return nil
+						return ErrDataMissing
 					}
-					runner.DisableRetry()
-				}
-				if strings.Contains(err.Error(), FAILED_DOWNLOAD_ERROR) || strings.Contains(err.Error(), INTERRUPTED_ERROR) {
-					Engine.Pause(TIMEBREAK_UNKNOWN_REQUEST_ERROR)
 				}
 			}
 			return err
 		}
 
 		startedAt := time.Now()
-		err = downloadFile(url, outputFP, runner.MustInterrupt, func(current int64, total int64) {
+		remote, err := downloadWithFailover(t, url, outputFP, runner.MustInterrupt, func(current int64, total int64) {
 			printProgressLog(t, current, total, startedAt)
+		}, func(size int64) error {
+			return DiskGuard.reserve(runner.ID, outputFP, size)
 		})
 
 		if err != nil {
@@ -307,7 +355,7 @@ func addArchiveDownloaderProcess(runner *gorunner.Runner) {
 			for _, a := range t.GetTargetedAssets() {
 				for _, sass := range set.Assets {
 					if a == sass.Address.AssetType {
-						c := sass.FindConsistencyByTimeframe(time.Duration(Engine.status.MinTimeframe) * time.Millisecond)
+						c := sass.FindConsistencyByTimeframe(Engine.getMinTimeframe())
 						if c == nil {
 							return err
 						}
@@ -322,19 +370,37 @@ func addArchiveDownloaderProcess(runner *gorunner.Runner) {
 				return err2
 			}
 			if e := handleDownloadError(perfectURL, t, err); e != nil {
+				if errors.Is(e, ErrDataMissing) {
+					return nil
+				}
 				return e
 			}
 		}
 
+		if remote != nil {
+			if err := writeRemoteArchive(getRemoteArchivePath(date, set.Settings, t), remote); err != nil {
+				return err
+			}
+		}
+		if err := storeLocalFile(outputFP); err != nil {
+			return err
+		}
+		// a republished archive is fragmented again right away (refresh only fragments the dates after the consistency)
+		if republished, _ := ReadRepublishedArchive(date, set.Settings, t); republished != nil {
+			Held.rerun(buildArchiveFragmenter(date, set, t))
+		}
 		return nil
 	})
 
 }
 
+func downloaderID(date string, set pcommon.SetSettings, t pcommon.ArchiveType) string {
+	return fmt.Sprintf("dl-%s-%s-%s", set.IDString(), date, string(t))
+}
+
 func buildArchiveDownloader(date string, set *pcommon.SetJSON, t pcommon.ArchiveType) *gorunner.Runner {
 
-	id := fmt.Sprintf("dl-%s-%s-%s", set.Settings.IDString(), date, string(t))
-	runner := gorunner.NewRunner(id)
+	runner := gorunner.NewRunner(downloaderID(date, set.Settings, t))
 
 	runner.AddArgs(ARG_VALUE_DATE, date)
 	runner.AddArgs(ARG_VALUE_SET, set)
@@ -5,6 +5,7 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/fantasim/gorunner"
@@ -18,73 +19,199 @@ var CountRPCRequests = 0
 
 type engine struct {
 	*gorunner.Engine
-	client     *pcommon.RPCClient
-	activeSets map[string]*pcommon.SetJSON
-	status     *pcommon.GetStatusResponse
-	mu         sync.RWMutex
+	// nil without parser (custom set provider)
+	client       *pcommon.RPCClient
+	provider     SetProvider
+	activeSets   map[string]*pcommon.SetJSON
+	minTimeframe time.Duration
+
+	pendingNotifications pendingNotifications
+	stopWatch            func()
+	// Start locked ARCHIVES_DIR, the state is persisted (see persistState)
+	started      atomic.Bool
+	shuttingDown atomic.Bool
+
+	mu        sync.RWMutex
+	refreshMu sync.Mutex
 }
 
-func (e *engine) Init() {
+/*
+Init builds the engine singleton. If provider is nil, sets are fetched from the parser over RPC. Otherwise the engine
+runs without parser: no RPC client is created, and the parser notifications (fragments ready, missing data) are not sent.
+Init writes nothing and starts no background loop, the commands only reading the archives run on it as is (see Start).
+*/
+func (e *engine) Init(provider SetProvider) {
 	if Engine == nil {
-		url := "ws://localhost:" + pcommon.Env.PARSER_SERVER_PORT + "/"
-		client := pcommon.RPC.NewClient(url, time.Second*2, true)
-		client.Connect()
-		options := gorunner.NewEngineOptions().
-			SetName("Archiver").
-			SetMaxSimultaneousRunner(pcommon.Env.MAX_SIMULTANEOUS_PARSING).SetMaxRetry(MAX_RETRY_PER_DOWLOAD_FAILED).
-			SetshouldRunAgain(func(taskID string, lastExecutionTime time.Time) bool {
-				return time.Since(lastExecutionTime) > time.Hour*6
-			})
+		var client *pcommon.RPCClient = nil
+		if provider == nil {
+			url := "ws://localhost:" + pcommon.Env.PARSER_SERVER_PORT + "/"
+			client = pcommon.RPC.NewClient(url, time.Second*2, true)
+			client.Connect()
+			provider = NewRPCSetProvider(client)
+		}
 		Engine = &engine{
-			Engine:     gorunner.NewEngine(options),
+			Engine:     newRunnerEngine(),
 			client:     client,
+			provider:   provider,
 			activeSets: make(map[string]*pcommon.SetJSON),
 			mu:         sync.RWMutex{},
 		}
-		go func(eng *engine) {
-			for {
-				time.Sleep(time.Second * 5)
-				if eng.CountQueued() > 0 {
-					fmt.Println("")
-					eng.PrintStatus()
-					fmt.Println("")
-				}
+		if err := initStorage(); err != nil {
+			log.Fatalf("Error initializing storage: %s", err.Error())
+		}
+		if err := initTiering(); err != nil {
+			log.Fatalf("Error initializing tiering: %s", err.Error())
+		}
+		if downloadClient == nil {
+			client, err := newDownloadClient()
+			if err != nil {
+				log.Fatalf("Error initializing http client: %s", err.Error())
 			}
-		}(Engine)
+			downloadClient = client
+		}
+		Bandwidth.setConfig(bandwidthConfig{
+			Limit:    Env.BANDWIDTH_LIMIT,
+			PerHost:  Env.BANDWIDTH_LIMIT_PER_HOST,
+			Schedule: Env.BANDWIDTH_SCHEDULE,
+		})
 	}
 }
 
-func (e *engine) refreshStatus() error {
-	CountRPCRequests++
-	status, err := pcommon.RPC.ParserRequests.FetchStatus(e.client)
+func newRunnerEngine() *gorunner.Engine {
+	options := gorunner.NewEngineOptions().
+		SetName("Archiver").
+		SetMaxSimultaneousRunner(pcommon.Env.MAX_SIMULTANEOUS_PARSING).SetMaxRetry(MAX_RETRY_PER_RUNNER).
+		SetshouldRunAgain(func(taskID string, lastExecutionTime time.Time) bool {
+			// a failed runner is done for the engine, until the backoff adds it back (or it must run on new data, see Held.rerun)
+			return time.Since(lastExecutionTime) > time.Hour*6 || Held.isReleasing(taskID)
+		})
+	return gorunner.NewEngine(options)
+}
+
+/*
+Start locks ARCHIVES_DIR, reloads the persisted state of the engine and starts the disk guard. It is called by the daemon, and by the commands
+running runners or deleting archives before they do (they persist the state on shutdown). The other commands only read, and leave the state as is.
+It fails if another process (the daemon or a command) already runs runners on ARCHIVES_DIR.
+*/
+func (e *engine) Start() error {
+	if err := lockEngine(); err != nil {
+		return err
+	}
+	if err := e.loadState(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Warn("Error loading archiver state")
+	}
+	e.started.Store(true)
+	go DiskGuard.Run()
+	return nil
+}
+
+func (e *engine) refreshMinTimeframe() error {
+	minTimeframe, err := e.provider.FetchMinTimeframe()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
 		}).Error("Error fetching status")
 		return err
 	}
-	e.status = status
+	e.mu.Lock()
+	e.minTimeframe = minTimeframe
+	e.mu.Unlock()
 	return nil
 }
 
+// getMinTimeframe returns the min timeframe of the last refresh, 0 before the first one.
+func (e *engine) getMinTimeframe() time.Duration {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.minTimeframe
+}
+
+// RunRefreshLoop refreshes the sets every SET_POLLING_INTERVAL while the provider can't detect their changes,
+// and only every SET_POLLING_INTERVAL_WATCHED as a safety net while it does.
+func (e *engine) RunRefreshLoop() {
+	e.stopWatch = e.provider.Watch(func() {
+		go e.onSetChanges()
+	})
+	go e.RunRetentionLoop()
+	go e.RunRevalidationLoop()
+	go e.RunMissingDataLoop()
+	go e.RunNotificationLoop()
+	go Tiering.RunLoop()
+	go Bandwidth.RunConfigWatcher()
+	go func() {
+		for !e.shuttingDown.Load() {
+			time.Sleep(time.Second * 5)
+			if e.CountQueued() > 0 {
+				fmt.Println("")
+				e.PrintStatus()
+				fmt.Println("")
+			}
+		}
+	}()
+
+	lastRefresh := time.Time{}
+	for !e.shuttingDown.Load() {
+		if !e.provider.Watching() || time.Since(lastRefresh) >= SET_POLLING_INTERVAL_WATCHED {
+			e.RefreshSets()
+			lastRefresh = time.Now()
+		}
+		time.Sleep(SET_POLLING_INTERVAL)
+	}
+}
+
+func (e *engine) onSetChanges() {
+	e.refreshMu.Lock()
+	// the consistencies may have changed as well as the min timeframe, the previous one is kept if it can't be fetched
+	e.refreshMinTimeframe()
+	e.refreshMu.Unlock()
+	e.RefreshSets()
+}
+
 func (e *engine) RefreshSets() {
-	if e.status == nil {
-		err := e.refreshStatus()
+	e.refreshMu.Lock()
+	defer e.refreshMu.Unlock()
+
+	if e.shuttingDown.Load() {
+		return
+	}
+
+	sets, err := e.unsafeLoadSets()
+	if err != nil {
+		return
+	}
+
+	for _, set := range sets {
+		handleSet(e, set)
+	}
+}
+
+// LoadSets fetches the active sets from the provider without scheduling any runner.
+func (e *engine) LoadSets() ([]*pcommon.SetJSON, error) {
+	e.refreshMu.Lock()
+	defer e.refreshMu.Unlock()
+	return e.unsafeLoadSets()
+}
+
+func (e *engine) unsafeLoadSets() ([]*pcommon.SetJSON, error) {
+	if e.getMinTimeframe() == 0 {
+		err := e.refreshMinTimeframe()
 		if err != nil {
-			return
+			return nil, err
 		}
 	}
 
-	CountRPCRequests++
-	newSetList, err := pcommon.RPC.ParserRequests.FetchAvailableSetList(e.client)
+	newSetList, err := e.provider.FetchSetList()
 	if err != nil {
 		log.WithFields(log.Fields{
 			"error": err.Error(),
 		}).Error("Error fetching available pair set list")
-		return
+		return nil, err
 	}
 
 	e.mu.Lock()
+	defer e.mu.Unlock()
 	for _, oldSet := range e.activeSets {
 		_, ok := lo.Find(newSetList, func(ns pcommon.SetJSON) bool {
 			return ns.Settings.IDString() == oldSet.Settings.IDString()
@@ -99,18 +226,18 @@ func (e *engine) RefreshSets() {
 		set := &newSetList[i]
 		e.activeSets[id] = set
 	}
-	e.mu.Unlock()
-
+	sets := make([]*pcommon.SetJSON, 0, len(e.activeSets))
 	for _, set := range e.activeSets {
-		handleSet(e, set)
+		sets = append(sets, set)
 	}
+	return sets, nil
 }
 
-func handleSet(e *engine, set *pcommon.SetJSON) error {
-	if err := set.Settings.IsValid(); err != nil {
-		return err
-	}
-
+/*
+scheduledArchives returns the [archive type, date] pairs a set needs:
+the days from the end of the consistency of each asset (at the min timeframe) until yesterday.
+*/
+func scheduledArchives(set *pcommon.SetJSON, minTimeframe time.Duration) [][]string {
 	type DL struct {
 		AssetID pcommon.AssetType
 		Date    string
@@ -121,7 +248,7 @@ func handleSet(e *engine, set *pcommon.SetJSON) error {
 		if len(asset.Address.Dependencies) > 0 {
 			continue
 		}
-		c := asset.FindConsistencyByTimeframe(time.Duration(e.status.MinTimeframe) * time.Millisecond)
+		c := asset.FindConsistencyByTimeframe(minTimeframe)
 		if c == nil {
 			continue
 		}
@@ -135,26 +262,32 @@ func handleSet(e *engine, set *pcommon.SetJSON) error {
 			})
 		}
 	}
-	filtered :=
-		lo.UniqBy(
-			lo.Filter(
-				//map
-				lo.Map(list, func(i DL, index int) []string {
-					t := i.AssetID.GetRequiredArchiveType()
-					if t == nil {
-						return nil
-					}
-					return []string{string(*t), i.Date}
-				}),
-				//filter
-				func(elem []string, index int) bool {
-					return elem != nil
-				}),
-			//uniqBy
-			func(i []string) string {
-				return i[0] + i[1]
-			})
+	return lo.UniqBy(
+		lo.Filter(
+			//map
+			lo.Map(list, func(i DL, index int) []string {
+				t := i.AssetID.GetRequiredArchiveType()
+				if t == nil {
+					return nil
+				}
+				return []string{string(*t), i.Date}
+			}),
+			//filter
+			func(elem []string, index int) bool {
+				return elem != nil
+			}),
+		//uniqBy
+		func(i []string) string {
+			return i[0] + i[1]
+		})
+}
 
+func handleSet(e *engine, set *pcommon.SetJSON) error {
+	if err := set.Settings.IsValid(); err != nil {
+		return err
+	}
+
+	filtered := scheduledArchives(set, e.getMinTimeframe())
 	if len(filtered) > 0 {
 
 		checked := map[pcommon.ArchiveType]bool{}
@@ -181,43 +314,70 @@ func handleSet(e *engine, set *pcommon.SetJSON) error {
 }
 
 func (e *engine) DownloadArchive(date string, set *pcommon.SetJSON, at pcommon.ArchiveType) {
-	e.Add(buildArchiveDownloader(date, set, at))
+	runner := buildArchiveDownloader(date, set, at)
+	if !Held.holdRestored(runner) {
+		e.Add(runner)
+	}
 }
 
-func (e *engine) FragmentDownloadedArchive(date string, set *pcommon.SetJSON, at pcommon.ArchiveType) error {
+// needsFragmenter returns true if the raw archive of a date is stored (for more than 2 minutes) and some of its fragments are missing.
+func needsFragmenter(date string, set *pcommon.SetJSON, at pcommon.ArchiveType) (bool, error) {
 	archivePath := at.GetArchiveZipPath(date, set.Settings)
-	stat, err := os.Stat(archivePath)
+	stat, err := Output.Stat(archivePath)
 	if err != nil && !os.IsNotExist(err) {
-		return err
+		return false, err
 	}
 	if err != nil && os.IsNotExist(err) {
-		return nil
+		return false, nil
 	}
-	if stat.ModTime().Add(time.Minute * 2).After(time.Now()) {
-		return nil
+	if stat.ModTime.Add(time.Minute * 2).After(time.Now()) {
+		return false, nil
 	}
 
 	tree, ok := pcommon.ArchivesIndex[at]
 	if !ok {
-		return fmt.Errorf("archive tree not found")
+		return false, fmt.Errorf("archive tree not found")
 	}
 	countFound := 0
 	for _, col := range tree.Columns {
-		if _, err := os.Stat(set.Settings.BuildArchiveFilePath(col.Asset, date, "zip")); err == nil {
+		if fileExists(set.Settings.BuildArchiveFilePath(col.Asset, date, "zip")) {
 			countFound++
 		}
 	}
 
-	if countFound == len(tree.Columns) {
-		return nil
-	}
+	return countFound != len(tree.Columns), nil
+}
 
-	e.Add(buildArchiveFragmenter(date, set, at))
+func (e *engine) FragmentDownloadedArchive(date string, set *pcommon.SetJSON, at pcommon.ArchiveType) error {
+	needed, err := needsFragmenter(date, set, at)
+	if err != nil || !needed {
+		return err
+	}
+	runner := buildArchiveFragmenter(date, set, at)
+	if !Held.holdRestored(runner) {
+		e.Add(runner)
+	}
 	return nil
 }
 
 func (e *engine) StopSetRunners(set *pcommon.SetJSON) {
-	e.CancelRunnersByArgs(map[string]interface{}{
+	args := map[string]interface{}{
 		ARG_VALUE_SET: set,
-	})
+	}
+	Held.drop(args)
+	e.CancelRunnersByArgs(args)
+}
+
+// WaitIdle blocks until no runner is queued, running or held for a retry (used by the one shot commands).
+func (e *engine) WaitIdle() {
+	idleChecks := 0
+	for idleChecks < 2 {
+		time.Sleep(time.Second)
+		// a failed runner is held once its process returned, so the engine must be seen idle twice
+		if e.CountQueued() == 0 && e.CountRunning() == 0 && Held.count() == 0 {
+			idleChecks++
+		} else {
+			idleChecks = 0
+		}
+	}
 }
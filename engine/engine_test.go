@@ -0,0 +1,136 @@
+package engine
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+// testSet returns a binance spot set whose trades are consistent until daysAgo days ago at minTimeframe.
+func testSet(minTimeframe time.Duration, daysAgo int) pcommon.SetJSON {
+	end := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, -daysAgo)
+	return pcommon.SetJSON{
+		Settings: pcommon.SetSettings{
+			ID: []string{"BTC", "USDT"},
+			Assets: []pcommon.AssetSettings{{
+				Address:     pcommon.AssetAddressParsedWithoutSetID{AssetType: pcommon.Asset.SPOT_PRICE},
+				MinDataDate: "2024-01-01",
+			}},
+			Settings: map[string]int64{"binance": 1},
+		},
+		Assets: []pcommon.AssetJSON{{
+			Address: pcommon.AssetAddressParsedJSON{SetID: []string{"BTC", "USDT"}, AssetType: pcommon.Asset.SPOT_PRICE},
+			Consistencies: []pcommon.Consistency{{
+				Range:     [2]pcommon.TimeUnit{pcommon.NewTimeUnitFromTime(end.AddDate(0, 0, -30)), pcommon.NewTimeUnitFromTime(end)},
+				Timeframe: minTimeframe.Milliseconds(),
+			}},
+			Decimals: 2,
+		}},
+	}
+}
+
+// useTestEngine replaces Engine with a dedicated engine for the test, paused unless run is true: the shared one is paused by
+// the other tests, and gorunner can't unpause it nor pause it again without racing.
+func useTestEngine(t *testing.T, run bool) {
+	t.Helper()
+	previous := Engine
+	Engine = &engine{Engine: newRunnerEngine(), provider: NewMemorySetProvider(time.Minute), activeSets: make(map[string]*pcommon.SetJSON)}
+	if !run {
+		Engine.Pause(time.Hour)
+	}
+	t.Cleanup(func() { Engine = previous })
+}
+
+func waitQueued(t *testing.T, expected int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for Engine.CountQueued() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d runners queued instead of %d", Engine.CountQueued(), expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRefreshSetsWithMemoryProvider(t *testing.T) {
+	pcommon.Env.ARCHIVES_DIR = t.TempDir()
+	provider := NewMemorySetProvider(time.Minute, testSet(time.Minute, 3))
+	Engine.Init(provider)
+	if Engine.client != nil {
+		t.Fatal("RPC client created with a custom set provider")
+	}
+	// the runners are queued but never started: nothing is downloaded
+	useTestEngine(t, false)
+	Engine.provider = provider
+
+	Engine.RefreshSets()
+	if _, ok := Engine.activeSets["btcusdt"]; !ok {
+		t.Fatal("set not active after refresh")
+	}
+	// one downloader per day from the end of the consistency until yesterday
+	waitQueued(t, 3)
+
+	// the set is dropped by the provider: its runners are canceled
+	provider.SetSets()
+	Engine.RefreshSets()
+	if len(Engine.activeSets) != 0 {
+		t.Fatal("set still active after being removed")
+	}
+	waitQueued(t, 0)
+}
+
+func TestRunnerFailuresPersisted(t *testing.T) {
+	pcommon.Env.ARCHIVES_DIR = t.TempDir()
+	set := testSet(time.Minute, 3)
+	date := "2024-01-15"
+	runner := buildArchiveDownloader(date, &set, pcommon.BINANCE_SPOT_TRADES)
+
+	Backoff.giveUp(runner, ErrInvalidArchive)
+	f, err := ReadRunnerFailure(date, set.Settings, pcommon.BINANCE_SPOT_TRADES, runner.ID)
+	if err != nil || f == nil || !f.GaveUp || f.Error != ErrInvalidArchive.Error() {
+		t.Fatalf("failure not saved: %+v (%v)", f, err)
+	}
+	if day := archiveDayStatus(date, &set, pcommon.BINANCE_SPOT_TRADES, false); day.Status != CALENDAR_FAILED {
+		t.Fatalf("day status %s instead of %s", day.Status, CALENDAR_FAILED)
+	}
+
+	Backoff.forget(runner)
+	if f, _ := ReadRunnerFailure(date, set.Settings, pcommon.BINANCE_SPOT_TRADES, runner.ID); f != nil {
+		t.Fatalf("failure kept after success: %+v", f)
+	}
+	if _, err := os.Stat(getRunnerFailuresPath(date, set.Settings, pcommon.BINANCE_SPOT_TRADES)); !os.IsNotExist(err) {
+		t.Fatal("failure file kept without failure")
+	}
+}
+
+func TestSetChangesKeepMinTimeframe(t *testing.T) {
+	pcommon.Env.ARCHIVES_DIR = t.TempDir()
+	provider := NewMemorySetProvider(time.Minute, testSet(time.Minute, 3))
+	useTestEngine(t, false)
+	Engine.provider = provider
+	Engine.RefreshSets()
+
+	// the readers never see the min timeframe reset while the sets change
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			Engine.onSetChanges()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if tf := Engine.getMinTimeframe(); tf != time.Minute {
+			t.Fatalf("min timeframe %s during a set change", tf)
+		}
+		if _, err := Engine.Calendar(CalendarQuery{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,468 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+type env struct {
+	SETS_FILE                     string
+	SHUTDOWN_TIMEOUT              time.Duration
+	DISK_LOW_WATERMARK            int64
+	RETENTION_POLICIES            map[pcommon.ArchiveType]RetentionPolicy
+	RETENTION_COLD_DIR            string
+	RETENTION_DRY_RUN             bool
+	STORAGE_BACKEND               string
+	S3_ENDPOINT                   string
+	S3_BUCKET                     string
+	S3_REGION                     string
+	S3_ACCESS_KEY                 string
+	S3_SECRET_KEY                 string
+	S3_PREFIX                     string
+	S3_TIMEOUT                    time.Duration
+	TIERING_LOCAL_DAYS            int
+	MIRROR_DIR                    string
+	MIRROR_TEMPLATES              map[pcommon.ArchiveType]string
+	MIRROR_MODE                   MirrorMode
+	MIRROR_REQUIRE_CHECKSUM       bool
+	DOWNLOAD_MIRRORS              map[pcommon.ArchiveType][]string
+	DOWNLOAD_MIRRORS_GLOBAL       []string
+	RATE_LIMIT_PER_HOST           float64
+	RETRY_POLICIES                map[string]RetryPolicy
+	BANDWIDTH_LIMIT               int64
+	BANDWIDTH_LIMIT_PER_HOST      map[string]int64
+	BANDWIDTH_SCHEDULE            []bandwidthWindow
+	BANDWIDTH_CONFIG_FILE         string
+	DOWNLOAD_MIN_RATE             int64
+	DOWNLOAD_STALL_WINDOW         time.Duration
+	DOWNLOAD_IDLE_TIMEOUT         time.Duration
+	DOWNLOAD_CONNECT_TIMEOUT      time.Duration
+	DOWNLOAD_HEADER_TIMEOUT       time.Duration
+	DOWNLOAD_SEGMENTS             int
+	DOWNLOAD_SEGMENT_MIN_SIZE     int64
+	DOWNLOAD_PROXY                string
+	HTTP_USER_AGENT               string
+	HTTP_HEADERS                  []HTTPHeader
+	HTTP_TLS_CA_FILE              string
+	HTTP_TLS_CLIENT_CERT          string
+	HTTP_TLS_CLIENT_KEY           string
+	HTTP_TLS_INSECURE_SKIP_VERIFY bool
+	HTTP_IDLE_CONN_TIMEOUT        time.Duration
+	HTTP_MAX_CONNS_PER_HOST       int
+	HTTP_MAX_IDLE_CONNS_PER_HOST  int
+	REVALIDATION_LOOKBACK_DAYS    int
+	REVALIDATION_INTERVAL         time.Duration
+	MISSING_DATA_RECHECK_INTERVAL time.Duration
+	ADMIN_ADDR                    string
+}
+
+var Env = env{
+	SETS_FILE:                     "",
+	SHUTDOWN_TIMEOUT:              2 * time.Minute,
+	DISK_LOW_WATERMARK:            5_000_000_000,
+	RETENTION_POLICIES:            map[pcommon.ArchiveType]RetentionPolicy{},
+	RETENTION_COLD_DIR:            "",
+	RETENTION_DRY_RUN:             false,
+	STORAGE_BACKEND:               STORAGE_LOCAL,
+	S3_ENDPOINT:                   "",
+	S3_BUCKET:                     "",
+	S3_REGION:                     "us-east-1",
+	S3_ACCESS_KEY:                 "",
+	S3_SECRET_KEY:                 "",
+	S3_PREFIX:                     "",
+	S3_TIMEOUT:                    30 * time.Minute,
+	TIERING_LOCAL_DAYS:            -1,
+	MIRROR_DIR:                    "",
+	MIRROR_TEMPLATES:              DEFAULT_MIRROR_TEMPLATES,
+	MIRROR_MODE:                   MIRROR_MOVE,
+	MIRROR_REQUIRE_CHECKSUM:       false,
+	DOWNLOAD_MIRRORS:              map[pcommon.ArchiveType][]string{},
+	DOWNLOAD_MIRRORS_GLOBAL:       []string{},
+	RATE_LIMIT_PER_HOST:           5,
+	RETRY_POLICIES:                DEFAULT_RETRY_POLICIES,
+	BANDWIDTH_LIMIT:               0,
+	BANDWIDTH_LIMIT_PER_HOST:      map[string]int64{},
+	BANDWIDTH_SCHEDULE:            []bandwidthWindow{},
+	BANDWIDTH_CONFIG_FILE:         "",
+	DOWNLOAD_MIN_RATE:             10 * 1024,
+	DOWNLOAD_STALL_WINDOW:         30 * time.Second,
+	DOWNLOAD_IDLE_TIMEOUT:         time.Minute,
+	DOWNLOAD_CONNECT_TIMEOUT:      10 * time.Second,
+	DOWNLOAD_HEADER_TIMEOUT:       30 * time.Second,
+	DOWNLOAD_SEGMENTS:             4,
+	DOWNLOAD_SEGMENT_MIN_SIZE:     64 * 1024 * 1024,
+	DOWNLOAD_PROXY:                "",
+	HTTP_USER_AGENT:               "pendule-archiver",
+	HTTP_HEADERS:                  []HTTPHeader{},
+	HTTP_TLS_CA_FILE:              "",
+	HTTP_TLS_CLIENT_CERT:          "",
+	HTTP_TLS_CLIENT_KEY:           "",
+	HTTP_TLS_INSECURE_SKIP_VERIFY: false,
+	HTTP_IDLE_CONN_TIMEOUT:        90 * time.Second,
+	HTTP_MAX_CONNS_PER_HOST:       0,
+	HTTP_MAX_IDLE_CONNS_PER_HOST:  8,
+	REVALIDATION_LOOKBACK_DAYS:    7,
+	REVALIDATION_INTERVAL:         24 * time.Hour,
+	MISSING_DATA_RECHECK_INTERVAL: 24 * time.Hour,
+	ADMIN_ADDR:                    "",
+}
+
+// parseByteSize parses a size in bytes with an optional kb, mb, gb or tb suffix (ex: 500mb, 10GB).
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		mult   int64
+	}{
+		{"tb", 1_000_000_000_000},
+		{"gb", 1_000_000_000},
+		{"mb", 1_000_000},
+		{"kb", 1_000},
+		{"b", 1},
+	}
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, u.suffix)), 64)
+			if err != nil || v < 0 {
+				return 0, fmt.Errorf("invalid size: %s", s)
+			}
+			return int64(v * float64(u.mult)), nil
+		}
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return v, nil
+}
+
+// Init reads the archiver settings from the environment (call after pcommon.Env.Init, which loads the .env file).
+func (e env) Init() {
+	// Sets file (sets are fetched from the parser if empty)
+	Env.SETS_FILE = os.Getenv("SETS_FILE")
+
+	// Max time given to running runners to finish on shutdown
+	shutdownTimeout := os.Getenv("SHUTDOWN_TIMEOUT")
+	if shutdownTimeout != "" {
+		d, err := time.ParseDuration(shutdownTimeout)
+		if err != nil || d < 0 {
+			log.Fatal("Error parsing SHUTDOWN_TIMEOUT")
+		}
+		Env.SHUTDOWN_TIMEOUT = d
+	}
+
+	// Free space under which the engine is paused
+	lowWatermark := os.Getenv("DISK_LOW_WATERMARK")
+	if lowWatermark != "" {
+		size, err := parseByteSize(lowWatermark)
+		if err != nil {
+			log.Fatal("Error parsing DISK_LOW_WATERMARK")
+		}
+		Env.DISK_LOW_WATERMARK = size
+	}
+
+	// Raw archive retention policies per archive type
+	retentionPolicies := os.Getenv("RETENTION_POLICIES")
+	if retentionPolicies != "" {
+		policies, err := parseRetentionPolicies(retentionPolicies)
+		if err != nil {
+			log.Fatalf("Error parsing RETENTION_POLICIES: %s", err.Error())
+		}
+		Env.RETENTION_POLICIES = policies
+	}
+
+	// Cold directory of the "move" retention policy
+	coldDir := os.Getenv("RETENTION_COLD_DIR")
+	if coldDir != "" {
+		if stat, err := os.Stat(coldDir); os.IsNotExist(err) || !stat.IsDir() {
+			log.Fatal("retention cold directory not found or is not a directory")
+		}
+		Env.RETENTION_COLD_DIR = coldDir
+	}
+
+	// Only log retention decisions
+	retentionDryRun := os.Getenv("RETENTION_DRY_RUN")
+	if retentionDryRun != "" {
+		dryRun, err := strconv.ParseBool(retentionDryRun)
+		if err != nil {
+			log.Fatal("Error parsing RETENTION_DRY_RUN")
+		}
+		Env.RETENTION_DRY_RUN = dryRun
+	}
+
+	// S3 compatible bucket (tiering or s3 storage backend)
+	Env.S3_ENDPOINT = os.Getenv("S3_ENDPOINT")
+	if Env.S3_ENDPOINT != "" {
+		Env.S3_BUCKET = os.Getenv("S3_BUCKET")
+		if Env.S3_BUCKET == "" {
+			log.Fatal("S3_BUCKET is required with S3_ENDPOINT")
+		}
+		if region := os.Getenv("S3_REGION"); region != "" {
+			Env.S3_REGION = region
+		}
+		Env.S3_ACCESS_KEY = os.Getenv("S3_ACCESS_KEY")
+		Env.S3_SECRET_KEY = os.Getenv("S3_SECRET_KEY")
+		Env.S3_PREFIX = os.Getenv("S3_PREFIX")
+		// Max duration of a request to the bucket, body included (0: none)
+		if timeout := os.Getenv("S3_TIMEOUT"); timeout != "" {
+			d, err := time.ParseDuration(timeout)
+			if err != nil || d < 0 {
+				log.Fatal("Error parsing S3_TIMEOUT")
+			}
+			Env.S3_TIMEOUT = d
+		}
+	}
+
+	// Storage of raw archives and fragments (local or s3)
+	storageBackend := os.Getenv("STORAGE_BACKEND")
+	if storageBackend != "" {
+		if storageBackend != STORAGE_LOCAL && storageBackend != STORAGE_S3 {
+			log.Fatal("Invalid STORAGE_BACKEND (local or s3)")
+		}
+		if storageBackend == STORAGE_S3 && Env.S3_ENDPOINT == "" {
+			log.Fatal("S3_ENDPOINT is required with the s3 STORAGE_BACKEND")
+		}
+		Env.STORAGE_BACKEND = storageBackend
+	}
+
+	// Days local copies of offloaded files are kept (-1: never deleted)
+	tieringLocalDays := os.Getenv("TIERING_LOCAL_DAYS")
+	if tieringLocalDays != "" {
+		days, err := strconv.Atoi(tieringLocalDays)
+		if err != nil || days < -1 {
+			log.Fatal("Error parsing TIERING_LOCAL_DAYS")
+		}
+		Env.TIERING_LOCAL_DAYS = days
+	}
+
+	// Local mirror of pre-downloaded archives (ARCHIVES_DIR by default)
+	Env.MIRROR_DIR = os.Getenv("MIRROR_DIR")
+	if Env.MIRROR_DIR == "" {
+		Env.MIRROR_DIR = pcommon.Env.ARCHIVES_DIR
+	}
+
+	// Path templates of the mirrored archives per archive type
+	mirrorTemplates := os.Getenv("MIRROR_TEMPLATES")
+	if mirrorTemplates != "" {
+		templates, err := parseMirrorTemplates(mirrorTemplates)
+		if err != nil {
+			log.Fatalf("Error parsing MIRROR_TEMPLATES: %s", err.Error())
+		}
+		Env.MIRROR_TEMPLATES = templates
+	}
+
+	// Move or copy the mirrored archives
+	mirrorMode := os.Getenv("MIRROR_MODE")
+	if mirrorMode != "" {
+		if MirrorMode(mirrorMode) != MIRROR_MOVE && MirrorMode(mirrorMode) != MIRROR_COPY {
+			log.Fatal("Invalid MIRROR_MODE (move or copy)")
+		}
+		Env.MIRROR_MODE = MirrorMode(mirrorMode)
+	}
+
+	// Ignore the mirrored archives without .CHECKSUM file
+	requireChecksum := os.Getenv("MIRROR_REQUIRE_CHECKSUM")
+	if requireChecksum != "" {
+		require, err := strconv.ParseBool(requireChecksum)
+		if err != nil {
+			log.Fatal("Error parsing MIRROR_REQUIRE_CHECKSUM")
+		}
+		Env.MIRROR_REQUIRE_CHECKSUM = require
+	}
+
+	// Prioritized base URLs tried before data.binance.vision
+	downloadMirrors := os.Getenv("DOWNLOAD_MIRRORS")
+	if downloadMirrors != "" {
+		perType, global, err := parseDownloadMirrors(downloadMirrors)
+		if err != nil {
+			log.Fatalf("Error parsing DOWNLOAD_MIRRORS: %s", err.Error())
+		}
+		Env.DOWNLOAD_MIRRORS = perType
+		Env.DOWNLOAD_MIRRORS_GLOBAL = global
+	}
+
+	// Max requests per second sent to a download host
+	rateLimit := os.Getenv("RATE_LIMIT_PER_HOST")
+	if rateLimit != "" {
+		rate, err := strconv.ParseFloat(rateLimit, 64)
+		if err != nil || rate <= 0 {
+			log.Fatal("Error parsing RATE_LIMIT_PER_HOST")
+		}
+		Env.RATE_LIMIT_PER_HOST = rate
+	}
+
+	// Retry schedules per error class
+	retryPolicies := os.Getenv("RETRY_POLICIES")
+	if retryPolicies != "" {
+		policies, err := parseRetryPolicies(retryPolicies)
+		if err != nil {
+			log.Fatalf("Error parsing RETRY_POLICIES: %s", err.Error())
+		}
+		Env.RETRY_POLICIES = policies
+	}
+
+	// Download bandwidth per second (0: unlimited)
+	bandwidthLimit := os.Getenv("BANDWIDTH_LIMIT")
+	if bandwidthLimit != "" {
+		limit, err := parseByteSize(bandwidthLimit)
+		if err != nil {
+			log.Fatal("Error parsing BANDWIDTH_LIMIT")
+		}
+		Env.BANDWIDTH_LIMIT = limit
+	}
+
+	// Download bandwidth per second of some hosts
+	hostBandwidthLimits := os.Getenv("BANDWIDTH_LIMIT_PER_HOST")
+	if hostBandwidthLimits != "" {
+		limits, err := parseHostBandwidthLimits(hostBandwidthLimits)
+		if err != nil {
+			log.Fatalf("Error parsing BANDWIDTH_LIMIT_PER_HOST: %s", err.Error())
+		}
+		Env.BANDWIDTH_LIMIT_PER_HOST = limits
+	}
+
+	// Download bandwidth per second replacing BANDWIDTH_LIMIT during time windows
+	bandwidthSchedule := os.Getenv("BANDWIDTH_SCHEDULE")
+	if bandwidthSchedule != "" {
+		schedule, err := parseBandwidthSchedule(bandwidthSchedule)
+		if err != nil {
+			log.Fatalf("Error parsing BANDWIDTH_SCHEDULE: %s", err.Error())
+		}
+		Env.BANDWIDTH_SCHEDULE = schedule
+	}
+
+	// JSON file overriding the bandwidth limits, reloaded on change
+	Env.BANDWIDTH_CONFIG_FILE = os.Getenv("BANDWIDTH_CONFIG_FILE")
+
+	// Min download rate over DOWNLOAD_STALL_WINDOW under which a download is stalled (0: disabled)
+	minRate := os.Getenv("DOWNLOAD_MIN_RATE")
+	if minRate != "" {
+		rate, err := parseByteSize(minRate)
+		if err != nil {
+			log.Fatal("Error parsing DOWNLOAD_MIN_RATE")
+		}
+		Env.DOWNLOAD_MIN_RATE = rate
+	}
+
+	// Download timeouts
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"DOWNLOAD_STALL_WINDOW", &Env.DOWNLOAD_STALL_WINDOW},
+		{"DOWNLOAD_IDLE_TIMEOUT", &Env.DOWNLOAD_IDLE_TIMEOUT},
+		{"DOWNLOAD_CONNECT_TIMEOUT", &Env.DOWNLOAD_CONNECT_TIMEOUT},
+		{"DOWNLOAD_HEADER_TIMEOUT", &Env.DOWNLOAD_HEADER_TIMEOUT},
+	}
+	for _, d := range durations {
+		if v := os.Getenv(d.name); v != "" {
+			parsed, err := time.ParseDuration(v)
+			if err != nil || parsed < 0 {
+				log.Fatalf("Error parsing %s", d.name)
+			}
+			*d.value = parsed
+		}
+	}
+
+	// Max number of byte ranges a large archive is downloaded in concurrently (1: disabled)
+	segments := os.Getenv("DOWNLOAD_SEGMENTS")
+	if segments != "" {
+		n, err := strconv.Atoi(segments)
+		if err != nil || n < 1 {
+			log.Fatal("Error parsing DOWNLOAD_SEGMENTS")
+		}
+		Env.DOWNLOAD_SEGMENTS = n
+	}
+
+	// Min size of a segment: archives smaller than twice this size are downloaded at once
+	segmentMinSize := os.Getenv("DOWNLOAD_SEGMENT_MIN_SIZE")
+	if segmentMinSize != "" {
+		size, err := parseByteSize(segmentMinSize)
+		if err != nil || size <= 0 {
+			log.Fatal("Error parsing DOWNLOAD_SEGMENT_MIN_SIZE")
+		}
+		Env.DOWNLOAD_SEGMENT_MIN_SIZE = size
+	}
+
+	// HTTP client of the download hosts (the standard HTTPS_PROXY, HTTP_PROXY and NO_PROXY env are used if DOWNLOAD_PROXY is not set)
+	if proxy := os.Getenv("DOWNLOAD_PROXY"); proxy != "" {
+		Env.DOWNLOAD_PROXY = proxy
+	}
+	if userAgent := os.Getenv("HTTP_USER_AGENT"); userAgent != "" {
+		Env.HTTP_USER_AGENT = userAgent
+	}
+	headers, err := parseHTTPHeaders(os.Getenv("HTTP_HEADERS"))
+	if err != nil {
+		log.Fatalf("Error parsing HTTP_HEADERS: %s", err.Error())
+	}
+	Env.HTTP_HEADERS = headers
+	Env.HTTP_TLS_CA_FILE = os.Getenv("HTTP_TLS_CA_FILE")
+	Env.HTTP_TLS_CLIENT_CERT = os.Getenv("HTTP_TLS_CLIENT_CERT")
+	Env.HTTP_TLS_CLIENT_KEY = os.Getenv("HTTP_TLS_CLIENT_KEY")
+	Env.HTTP_TLS_INSECURE_SKIP_VERIFY = os.Getenv("HTTP_TLS_INSECURE_SKIP_VERIFY") == "true"
+
+	// 0 disables keep-alive
+	if idleTimeout := os.Getenv("HTTP_IDLE_CONN_TIMEOUT"); idleTimeout != "" {
+		d, err := time.ParseDuration(idleTimeout)
+		if err != nil || d < 0 {
+			log.Fatal("Error parsing HTTP_IDLE_CONN_TIMEOUT")
+		}
+		Env.HTTP_IDLE_CONN_TIMEOUT = d
+	}
+
+	// 0 is unlimited
+	connLimits := []struct {
+		name  string
+		value *int
+	}{
+		{"HTTP_MAX_CONNS_PER_HOST", &Env.HTTP_MAX_CONNS_PER_HOST},
+		{"HTTP_MAX_IDLE_CONNS_PER_HOST", &Env.HTTP_MAX_IDLE_CONNS_PER_HOST},
+	}
+	for _, l := range connLimits {
+		if v := os.Getenv(l.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				log.Fatalf("Error parsing %s", l.name)
+			}
+			*l.value = n
+		}
+	}
+
+	// Number of past days compared with the server to detect republished archives (0: disabled)
+	lookback := os.Getenv("REVALIDATION_LOOKBACK_DAYS")
+	if lookback != "" {
+		days, err := strconv.Atoi(lookback)
+		if err != nil || days < 0 {
+			log.Fatal("Error parsing REVALIDATION_LOOKBACK_DAYS")
+		}
+		Env.REVALIDATION_LOOKBACK_DAYS = days
+	}
+
+	revalidationInterval := os.Getenv("REVALIDATION_INTERVAL")
+	if revalidationInterval != "" {
+		d, err := time.ParseDuration(revalidationInterval)
+		if err != nil || d <= 0 {
+			log.Fatal("Error parsing REVALIDATION_INTERVAL")
+		}
+		Env.REVALIDATION_INTERVAL = d
+	}
+
+	// How often the missing archives are probed again (0: never)
+	missingRecheck := os.Getenv("MISSING_DATA_RECHECK_INTERVAL")
+	if missingRecheck != "" {
+		d, err := time.ParseDuration(missingRecheck)
+		if err != nil || d < 0 {
+			log.Fatal("Error parsing MISSING_DATA_RECHECK_INTERVAL")
+		}
+		Env.MISSING_DATA_RECHECK_INTERVAL = d
+	}
+
+	// Address of the JSON admin API (ex: 127.0.0.1:8890), disabled if empty
+	Env.ADMIN_ADDR = os.Getenv("ADMIN_ADDR")
+}
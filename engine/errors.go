@@ -0,0 +1,112 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	// the archive is not published (404)
+	ErrFileNotFound = errors.New("file not found")
+	// the host answered 429
+	ErrTooManyRequests = errors.New("too many requests")
+	// the host answered an unexpected status (5xx...)
+	ErrFailedDownload = errors.New("failed to download file")
+	// the request could not be sent or the response could not be read
+	ErrNetwork = errors.New("network error")
+	// the response size is missing or does not match the downloaded size
+	ErrInvalidFileSize = errors.New("invalid file size")
+	// the download went under DOWNLOAD_MIN_RATE over DOWNLOAD_STALL_WINDOW, or received nothing for DOWNLOAD_IDLE_TIMEOUT
+	ErrStalled = errors.New("download stalled")
+	// the downloaded archive does not match its published checksum
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// the published checksum of the downloaded archive could not be fetched, the archive is kept and verified again at the next attempt
+	ErrUnverified = errors.New("checksum unavailable")
+	// all the hosts serving the archive are blocked after a 429 (see RateLimiter)
+	ErrHostThrottled = errors.New("host throttled")
+	// the runner has been interrupted by the engine (cancel, shutdown)
+	ErrInterrupted = errors.New("interrupted")
+	// the runner would not fit on disk while keeping DISK_LOW_WATERMARK free
+	ErrInsufficientDiskSpace = errors.New("insufficient disk space")
+	// the raw archive can't be fragmented (corrupted zip, unexpected content)
+	ErrInvalidArchive = errors.New("invalid archive")
+	// the archive of a recent day is not published yet, it is downloaded again at a next refresh
+	ErrNotPublished = errors.New("not published yet")
+	// the archive is not published while the days around it are (see MissingData)
+	ErrDataMissing = errors.New("data missing on the server")
+)
+
+// HTTPError is a failed request of a download host. It wraps one of ErrFileNotFound, ErrTooManyRequests, ErrFailedDownload or ErrNetwork.
+type HTTPError struct {
+	URL        string
+	StatusCode int
+	// Retry-After header of a 429 or 503, 0 if missing
+	RetryAfter time.Duration
+	Err        error
+	// underlying error of an ErrNetwork
+	Cause error
+}
+
+func newHTTPError(url string, resp *http.Response) *HTTPError {
+	e := &HTTPError{
+		URL:        url,
+		StatusCode: resp.StatusCode,
+		RetryAfter: parseRetryAfter(resp.Header),
+		Err:        ErrFailedDownload,
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		e.Err = ErrFileNotFound
+	case http.StatusTooManyRequests:
+		e.Err = ErrTooManyRequests
+	}
+	return e
+}
+
+func newNetworkError(url string, cause error) *HTTPError {
+	return &HTTPError{URL: url, Err: ErrNetwork, Cause: cause}
+}
+
+func (e *HTTPError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%s: %s (%s)", e.Err.Error(), e.URL, e.Cause.Error())
+	}
+	return fmt.Sprintf("%s: %s (status %d)", e.Err.Error(), e.URL, e.StatusCode)
+}
+
+// Unwrap returns Err, the Cause of an ErrNetwork is matched by Is and As.
+func (e *HTTPError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the Cause of an ErrNetwork with errors.Is (Err is matched through Unwrap).
+func (e *HTTPError) Is(target error) bool {
+	return e.Cause != nil && errors.Is(e.Cause, target)
+}
+
+// As matches the Cause of an ErrNetwork with errors.As.
+func (e *HTTPError) As(target interface{}) bool {
+	return e.Cause != nil && errors.As(e.Cause, target)
+}
+
+/*
+Retryable returns false if retrying the same request can't succeed: a 4xx answer other than a 429 (the archive is not published,
+access denied, gone...). A 416 is retried too, the partial file it was resumed from has been deleted.
+*/
+func (e *HTTPError) Retryable() bool {
+	if e.StatusCode < 400 || e.StatusCode >= 500 {
+		return true
+	}
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode == http.StatusRequestedRangeNotSatisfiable
+}
+
+// isRetryable returns true if the same runner should be run again after err.
+func isRetryable(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Retryable()
+	}
+	return !errors.Is(err, ErrInvalidArchive) && !errors.Is(err, ErrDataMissing)
+}
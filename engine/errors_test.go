@@ -0,0 +1,47 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestHTTPErrorUnwrap(t *testing.T) {
+	err := error(newNetworkError("https://data.binance.vision/x.zip", context.DeadlineExceeded))
+	if !errors.Is(err, ErrNetwork) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("network error should match both ErrNetwork and its cause")
+	}
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.Err != ErrNetwork {
+		t.Fatal("network error should be an HTTPError")
+	}
+
+	err = newNetworkError("https://data.binance.vision/x.zip", &net.OpError{Op: "dial", Err: errors.New("connection refused")})
+	var opErr *net.OpError
+	if !errors.As(err, &opErr) || opErr.Op != "dial" {
+		t.Fatal("network error should match the type of its cause")
+	}
+	if errors.Is(&HTTPError{StatusCode: 503, Err: ErrFailedDownload}, context.DeadlineExceeded) {
+		t.Fatal("an error without cause should only match Err")
+	}
+}
+
+func TestHTTPErrorRetryable(t *testing.T) {
+	for status, retryable := range map[int]bool{
+		0:   true,
+		401: false,
+		403: false,
+		404: false,
+		410: false,
+		416: true,
+		429: true,
+		500: true,
+		503: true,
+	} {
+		e := &HTTPError{StatusCode: status, Err: ErrFailedDownload}
+		if e.Retryable() != retryable || isRetryable(e) != retryable {
+			t.Errorf("status %d retryable should be %t", status, retryable)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/fantasim/gorunner"
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+// RunnerFailure is the last error of a runner, kept until it succeeds.
+type RunnerFailure struct {
+	Error    string `json:"error"`
+	Class    string `json:"class,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+	At       int64  `json:"at"`
+	// the runner won't be retried (max attempts reached or error not retryable)
+	GaveUp bool `json:"gave_up"`
+}
+
+// getRunnerFailuresPath returns where the failures of the runners (downloader, fragmenter) of an archive are recorded, by runner ID.
+func getRunnerFailuresPath(date string, set pcommon.SetSettings, t pcommon.ArchiveType) string {
+	return filepath.Join(
+		pcommon.Env.ARCHIVES_DIR,
+		strings.ToUpper(set.IDString()),
+		"__failures",
+		string(t),
+		fmt.Sprintf("%s.json", date),
+	)
+}
+
+// readRunnerFailures returns an empty map without error if no runner of the archive failed.
+func readRunnerFailures(fp string) (map[string]RunnerFailure, error) {
+	failures := map[string]RunnerFailure{}
+	data, err := os.ReadFile(fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return failures, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &failures); err != nil {
+		return nil, err
+	}
+	return failures, nil
+}
+
+// ReadRunnerFailure returns the last failure of a runner of an archive, nil if it did not fail since its last success.
+func ReadRunnerFailure(date string, set pcommon.SetSettings, t pcommon.ArchiveType, runnerID string) (*RunnerFailure, error) {
+	failures, err := readRunnerFailures(getRunnerFailuresPath(date, set, t))
+	if err != nil {
+		return nil, err
+	}
+	if f, ok := failures[runnerID]; ok {
+		return &f, nil
+	}
+	return nil, nil
+}
+
+// serializes the read-modify-write of the failure records (runners of the same archive)
+var runnerFailuresMu sync.Mutex
+
+/*
+saveRunnerFailure records the failure of a runner (f nil clears it), so the calendar of any process reports it.
+The file is removed with its last failure.
+*/
+func saveRunnerFailure(runner *gorunner.Runner, f *RunnerFailure) {
+	date, _ := gorunner.GetArg[string](runner.Args, ARG_VALUE_DATE)
+	set, _ := gorunner.GetArg[*pcommon.SetJSON](runner.Args, ARG_VALUE_SET)
+	t, _ := gorunner.GetArg[pcommon.ArchiveType](runner.Args, ARG_VALUE_ARCHIVE_TYPE)
+	if date == "" || set == nil || t == "" {
+		return
+	}
+	fp := getRunnerFailuresPath(date, set.Settings, t)
+
+	runnerFailuresMu.Lock()
+	defer runnerFailuresMu.Unlock()
+	failures, err := readRunnerFailures(fp)
+	if err == nil {
+		if f == nil {
+			if _, ok := failures[runner.ID]; !ok {
+				return
+			}
+			delete(failures, runner.ID)
+		} else {
+			failures[runner.ID] = *f
+		}
+		err = writeRunnerFailures(fp, failures)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"rid":   runner.ID,
+			"error": err.Error(),
+		}).Warn("Failed to save runner failure")
+	}
+}
+
+func writeRunnerFailures(fp string, failures map[string]RunnerFailure) error {
+	if len(failures) == 0 {
+		if err := os.Remove(fp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := pcommon.File.EnsureDir(filepath.Dir(fp)); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(failures, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fp, data, 0644)
+}
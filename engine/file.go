@@ -0,0 +1,35 @@
+package engine
+
+import (
+	"os"
+	"path/filepath"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+// moveFile renames src to dst, falling back to a copy when they are not on the same volume.
+func moveFile(src string, dst string) error {
+	if err := pcommon.File.EnsureDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	if err := copyFile(src, dst); err != nil {
+		return err
+	}
+	return os.Remove(src)
+}
+
+// copyFile copies src to dst through a temporary file, so dst is never partially written.
+func copyFile(src string, dst string) error {
+	if err := pcommon.File.EnsureDir(filepath.Dir(dst)); err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	if err := pcommon.File.CopyFile(src, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
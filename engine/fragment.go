@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+// FRAGMENT_ZIP_TIME is the modification time of every fragment zip entry: the same rows always give the same bytes.
+var FRAGMENT_ZIP_TIME = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+/*
+formatFragmentValue trims a value and formats it as a float with the decimals of the asset,
+or with the shortest representation if the set does not have the asset. Other values are kept as is.
+*/
+func formatFragmentValue(value string, asset *pcommon.AssetJSON) string {
+	value = strings.TrimSpace(value)
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return value
+	}
+	precision := int8(-1)
+	if asset != nil {
+		precision = asset.Decimals
+	}
+	return pcommon.Format.Float(v, precision)
+}
+
+// fragmentRowOrder returns the indexes of the lines of a raw archive sorted by time, lines with the same time keep their order.
+func fragmentRowOrder(times []string) []int {
+	units := make([]pcommon.TimeUnit, len(times))
+	order := make([]int, len(times))
+	for i := range times {
+		units[i] = pcommon.NewTimeUnitFromIntString(strings.TrimSpace(times[i]))
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return units[order[a]] < units[order[b]]
+	})
+	return order
+}
+
+/*
+writeFragmentCSV writes the csv of the fragment of an asset: a time and a value per line of the raw archive with a value, in order.
+progress is called before each line, the writing is interrupted with ErrInterrupted once it returns true.
+*/
+func writeFragmentCSV(w io.Writer, col pcommon.AssetBranch, asset *pcommon.AssetJSON, lines [][]string, headerXY map[string]int, times []string, order []int, progress func(i int) bool) (*ManifestFragment, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{string(pcommon.ColumnType.TIME), string(col.Asset)}); err != nil {
+		return nil, err
+	}
+
+	fragment := &ManifestFragment{Asset: col.Asset}
+	for i, idx := range order {
+		if progress(i) {
+			return nil, ErrInterrupted
+		}
+		value, err := branchValue(col, lines[idx], headerXY)
+		if err != nil {
+			return nil, err
+		}
+		value = formatFragmentValue(value, asset)
+		if len(value) == 0 {
+			continue
+		}
+		timeStr := strings.TrimSpace(times[idx])
+		if err := writer.Write([]string{timeStr, value}); err != nil {
+			return nil, err
+		}
+		fragment.addRow(timeStr)
+	}
+	writer.Flush()
+	return fragment, writer.Error()
+}
+
+// zipFragment zips the csv of a fragment, without the file system metadata of the csv (see FRAGMENT_ZIP_TIME).
+func zipFragment(csvPath string, zipPath string) error {
+	src, err := os.Open(csvPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	out, err := os.Create(zipPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	header := &zip.FileHeader{
+		Name:     filepath.Base(csvPath),
+		Method:   zip.Deflate,
+		Modified: FRAGMENT_ZIP_TIME,
+	}
+	header.SetMode(0644)
+	zw := zip.NewWriter(out)
+	entry, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(entry, src); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
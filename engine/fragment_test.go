@@ -0,0 +1,91 @@
+package engine
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files")
+
+const testRawArchive = "testdata/fragment/BTCUSDT-trades-2024-01-01.csv"
+
+// buildTestFragment fragments the test raw archive for one asset, the csv being modified at mtime before it is zipped.
+func buildTestFragment(t *testing.T, col pcommon.AssetBranch, asset *pcommon.AssetJSON, mtime time.Time) []byte {
+	t.Helper()
+	lines, headerXY, err := ParseFromCSV(testRawArchive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := pcommon.ArchivesIndex[pcommon.BINANCE_SPOT_TRADES]
+	times := make([]string, len(lines))
+	for i, line := range lines {
+		if times[i], err = branchValue(tree.Time, line, headerXY); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, string(col.Asset)+".csv")
+	zipPath := filepath.Join(dir, string(col.Asset)+".zip")
+	f, err := os.Create(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = writeFragmentCSV(f, col, asset, lines, headerXY, times, fragmentRowOrder(times), func(i int) bool { return false })
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(csvPath, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := zipFragment(csvPath, zipPath); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestFragmentGolden(t *testing.T) {
+	assets := map[pcommon.AssetType]*pcommon.AssetJSON{
+		pcommon.Asset.SPOT_PRICE: {Decimals: 2},
+		// not in the set: shortest float representation
+		pcommon.Asset.SPOT_VOLUME: nil,
+	}
+
+	for _, col := range pcommon.ArchivesIndex[pcommon.BINANCE_SPOT_TRADES].Columns {
+		col := col
+		t.Run(string(col.Asset), func(t *testing.T) {
+			first := buildTestFragment(t, col, assets[col.Asset], time.Now())
+			second := buildTestFragment(t, col, assets[col.Asset], time.Now().Add(-48*time.Hour))
+			if !bytes.Equal(first, second) {
+				t.Fatal("fragments of the same raw archive differ")
+			}
+
+			golden := filepath.Join("testdata", "fragment", string(col.Asset)+".zip.golden")
+			if *updateGolden {
+				if err := os.WriteFile(golden, first, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(first, expected) {
+				t.Fatalf("fragment differs from %s (run with -update to rewrite it)", golden)
+			}
+		})
+	}
+}
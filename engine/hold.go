@@ -0,0 +1,202 @@
+package engine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/fantasim/gorunner"
+)
+
+/*
+heldRunners keeps out of the engine queue the runners that must not run yet (backoff, throttled host, disk space),
+and adds them back once they may run. A runner is never held back by its running filter: each time a filter returns
+false, gorunner arms a new timer executing the whole queue again, so the timers would multiply while the runner waits.
+A held runner is added back by its own timer (holdFor), or by the component holding it (release).
+*/
+type heldRunners struct {
+	runners map[string]*gorunner.Runner
+	timers  map[string]*time.Timer
+	// when the runners held for a while are added back, persisted with the state
+	retryAt map[string]time.Time
+	// retry times of the previous process, applied when the runners are queued again (see holdRestored)
+	restored map[string]time.Time
+	// being added back: the engine runs them again although they are done (see shouldRunAgain)
+	releasing map[string]bool
+	mu        sync.Mutex
+}
+
+var Held = &heldRunners{
+	runners:   make(map[string]*gorunner.Runner),
+	timers:    make(map[string]*time.Timer),
+	retryAt:   make(map[string]time.Time),
+	restored:  make(map[string]time.Time),
+	releasing: make(map[string]bool),
+}
+
+// hold keeps a failing runner out of the queue until release is called (gorunner does not retry it, see MAX_RETRY_PER_RUNNER).
+func (h *heldRunners) hold(runner *gorunner.Runner) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.runners[runner.ID] = runner
+}
+
+// holdFor holds a failing runner for d, it is added back by a single timer per runner.
+func (h *heldRunners) holdFor(runner *gorunner.Runner, d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.runners[runner.ID] = runner
+	h.unsafeArm(runner.ID, d)
+}
+
+func (h *heldRunners) unsafeArm(id string, d time.Duration) {
+	if t, ok := h.timers[id]; ok {
+		t.Stop()
+	}
+	h.timers[id] = time.AfterFunc(d, func() { h.release(id) })
+	h.retryAt[id] = time.Now().Add(d)
+}
+
+// release adds a held runner back to the engine.
+func (h *heldRunners) release(id string) {
+	// read before locking: the engine asks isReleasing while it holds its own lock
+	done := Engine.IsTaskDone(id)
+
+	h.mu.Lock()
+	runner, ok := h.runners[id]
+	if !ok {
+		h.mu.Unlock()
+		return
+	}
+	if !done {
+		// still returning the error it has been held for
+		h.unsafeArm(id, time.Second)
+		h.mu.Unlock()
+		return
+	}
+	if t, ok := h.timers[id]; ok {
+		t.Stop()
+		delete(h.timers, id)
+	}
+	delete(h.retryAt, id)
+	delete(h.runners, id)
+	h.mu.Unlock()
+
+	h.add(runner)
+}
+
+// add adds a runner to the engine, even if it is done since less than 6 hours (see shouldRunAgain).
+func (h *heldRunners) add(runner *gorunner.Runner) {
+	h.mu.Lock()
+	h.releasing[runner.ID] = true
+	h.mu.Unlock()
+
+	Engine.Add(runner)
+
+	h.mu.Lock()
+	delete(h.releasing, runner.ID)
+	h.mu.Unlock()
+}
+
+/*
+rerun adds a runner that must run again on new data (republished archive, fragments requeued by the verification):
+gorunner silently refuses a runner done since less than 6 hours. A runner still running is held until it is done,
+so it runs again after it.
+*/
+func (h *heldRunners) rerun(runner *gorunner.Runner) {
+	for _, r := range Engine.RunningRunners() {
+		if r.ID == runner.ID {
+			h.holdFor(runner, time.Second)
+			return
+		}
+	}
+	h.add(runner)
+}
+
+func (h *heldRunners) isReleasing(id string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.releasing[id]
+}
+
+// drop forgets the held runners whose args match (runners of a set that is not active anymore).
+func (h *heldRunners) drop(args map[string]interface{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, runner := range h.runners {
+		if runner.AreArgsEqual(args) {
+			if t, ok := h.timers[id]; ok {
+				t.Stop()
+				delete(h.timers, id)
+			}
+			delete(h.retryAt, id)
+			delete(h.runners, id)
+		}
+	}
+}
+
+func (h *heldRunners) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.runners)
+}
+
+// retryTimes returns when the runners held for a while (and the restored ones not queued yet) are added back, to persist them.
+func (h *heldRunners) retryTimes() map[string]int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	times := make(map[string]int64, len(h.retryAt)+len(h.restored))
+	for id, at := range h.restored {
+		times[id] = at.UnixMilli()
+	}
+	for id, at := range h.retryAt {
+		times[id] = at.UnixMilli()
+	}
+	return times
+}
+
+// restore keeps the retry times persisted by the previous process, the runners are rebuilt by the next refresh.
+func (h *heldRunners) restore(times map[string]int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for id, at := range times {
+		if t := time.UnixMilli(at); t.After(time.Now()) {
+			h.restored[id] = t
+		}
+	}
+}
+
+/*
+holdRestored holds a runner queued for the first time until the retry time the previous process held it for.
+It returns false if the runner may run now. The runner never ran in this process, it is added back without waiting to be done (see release).
+*/
+func (h *heldRunners) holdRestored(runner *gorunner.Runner) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	at, ok := h.restored[runner.ID]
+	if !ok {
+		return false
+	}
+	delete(h.restored, runner.ID)
+	d := time.Until(at)
+	if d <= 0 {
+		return false
+	}
+	if _, held := h.runners[runner.ID]; held {
+		return true
+	}
+	h.runners[runner.ID] = runner
+	h.retryAt[runner.ID] = at
+	h.timers[runner.ID] = time.AfterFunc(d, func() {
+		h.mu.Lock()
+		if h.runners[runner.ID] != runner {
+			h.mu.Unlock()
+			return
+		}
+		delete(h.timers, runner.ID)
+		delete(h.retryAt, runner.ID)
+		delete(h.runners, runner.ID)
+		h.mu.Unlock()
+		Engine.Add(runner)
+	})
+	return true
+}
@@ -0,0 +1,50 @@
+package engine
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fantasim/gorunner"
+)
+
+func waitRuns(t *testing.T, runs *atomic.Int32, expected int32) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runs.Load() != expected {
+		if time.Now().After(deadline) {
+			t.Fatalf("runner ran %d times instead of %d", runs.Load(), expected)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRerunDoneRunner(t *testing.T) {
+	useTestEngine(t, true)
+
+	runs := &atomic.Int32{}
+	build := func() *gorunner.Runner {
+		runner := gorunner.NewRunner("test-rerun")
+		runner.AddProcess(func() error {
+			runs.Add(1)
+			return nil
+		})
+		return runner
+	}
+
+	Engine.Add(build())
+	waitRuns(t, runs, 1)
+	for !Engine.IsTaskDone("test-rerun") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// done less than 6 hours ago: refused by the engine
+	Engine.Add(build())
+	time.Sleep(100 * time.Millisecond)
+	if runs.Load() != 1 {
+		t.Fatal("done runner added again")
+	}
+
+	Held.rerun(build())
+	waitRuns(t, runs, 2)
+}
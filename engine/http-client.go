@@ -0,0 +1,137 @@
+package engine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// HTTPHeader is a header added to the download requests, of every host if Host is empty.
+type HTTPHeader struct {
+	Host  string
+	Name  string
+	Value string
+}
+
+/*
+parseHTTPHeaders parses a semicolon separated list of [<host>=]<name>:<value>
+ex: X-Team:data;mirror.internal=Authorization:Bearer abc
+*/
+func parseHTTPHeaders(s string) ([]HTTPHeader, error) {
+	headers := []HTTPHeader{}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		h := HTTPHeader{}
+		// a '=' before the first ':' separates the host (values may contain '=')
+		if eq, colon := strings.Index(entry, "="), strings.Index(entry, ":"); eq >= 0 && (colon < 0 || eq < colon) {
+			h.Host = strings.TrimSpace(entry[:eq])
+			entry = entry[eq+1:]
+		}
+		kv := strings.SplitN(entry, ":", 2)
+		if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" {
+			return nil, fmt.Errorf("invalid http header: %s", entry)
+		}
+		h.Name = http.CanonicalHeaderKey(strings.TrimSpace(kv[0]))
+		h.Value = strings.TrimSpace(kv[1])
+		headers = append(headers, h)
+	}
+	return headers, nil
+}
+
+// headerTransport adds the User-Agent and the custom headers to the requests, without overriding the headers already set.
+type headerTransport struct {
+	base      http.RoundTripper
+	userAgent string
+	headers   []HTTPHeader
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request
+	req = req.Clone(req.Context())
+	if t.userAgent != "" && req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", t.userAgent)
+	}
+	for _, h := range t.headers {
+		if (h.Host == "" || h.Host == req.URL.Host) && req.Header.Get(h.Name) == "" {
+			req.Header.Set(h.Name, h.Value)
+		}
+	}
+	return t.base.RoundTrip(req)
+}
+
+func newTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: Env.HTTP_TLS_INSECURE_SKIP_VERIFY}
+	if Env.HTTP_TLS_CA_FILE != "" {
+		pem, err := os.ReadFile(Env.HTTP_TLS_CA_FILE)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", Env.HTTP_TLS_CA_FILE)
+		}
+		config.RootCAs = pool
+	}
+	if Env.HTTP_TLS_CLIENT_CERT != "" || Env.HTTP_TLS_CLIENT_KEY != "" {
+		cert, err := tls.LoadX509KeyPair(Env.HTTP_TLS_CLIENT_CERT, Env.HTTP_TLS_CLIENT_KEY)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// newDownloadClient builds the client of the download hosts from the HTTP_*, DOWNLOAD_PROXY and DOWNLOAD_*_TIMEOUT env.
+func newDownloadClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if Env.DOWNLOAD_PROXY != "" {
+		proxy, err := url.Parse(Env.DOWNLOAD_PROXY)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http proxy: %s", Env.DOWNLOAD_PROXY)
+		}
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	tlsConfig, err := newTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	transport.DialContext = (&net.Dialer{
+		Timeout:   Env.DOWNLOAD_CONNECT_TIMEOUT,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = Env.DOWNLOAD_CONNECT_TIMEOUT
+	transport.ResponseHeaderTimeout = Env.DOWNLOAD_HEADER_TIMEOUT
+	transport.DisableKeepAlives = Env.HTTP_IDLE_CONN_TIMEOUT == 0
+	transport.IdleConnTimeout = Env.HTTP_IDLE_CONN_TIMEOUT
+	transport.MaxConnsPerHost = Env.HTTP_MAX_CONNS_PER_HOST
+	transport.MaxIdleConnsPerHost = Env.HTTP_MAX_IDLE_CONNS_PER_HOST
+
+	return &http.Client{Transport: &headerTransport{
+		base:      transport,
+		userAgent: Env.HTTP_USER_AGENT,
+		headers:   Env.HTTP_HEADERS,
+	}}, nil
+}
+
+// downloadClient sends every request of the download hosts (archives, checksums, probes), built on engine init.
+var downloadClient *http.Client = nil
+
+// SetDownloadClient replaces the client of the download hosts, it must be called before Init.
+// The body of the downloads is still watched by a stallDetector, and their requests rate limited.
+func SetDownloadClient(client *http.Client) {
+	downloadClient = client
+}
@@ -0,0 +1,213 @@
+package engine
+
+import (
+	"archive/zip"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+type ImportStatus string
+
+const (
+	IMPORT_IMPORTED ImportStatus = "imported"
+	// the archive (or all its fragments) is already stored
+	IMPORT_EXISTS ImportStatus = "exists"
+	// the file is not an archive of an active set
+	IMPORT_SKIPPED ImportStatus = "skipped"
+	// the file failed its validation or could not be placed
+	IMPORT_INVALID ImportStatus = "invalid"
+)
+
+type ImportResult struct {
+	Path        string              `json:"path"`
+	SetID       string              `json:"set_id,omitempty"`
+	ArchiveType pcommon.ArchiveType `json:"archive_type,omitempty"`
+	Date        string              `json:"date,omitempty"`
+	Destination string              `json:"destination,omitempty"`
+	Status      ImportStatus        `json:"status"`
+	Reason      string              `json:"reason,omitempty"`
+}
+
+// Binance archive filenames: <SYMBOL>-<trades|bookDepth|metrics>-<date>.zip
+var archiveFilenameRegexp = regexp.MustCompile(`^([A-Za-z0-9]+)-(trades|bookDepth|metrics)-(\d{4}-\d{2}-\d{2})\.zip$`)
+
+/*
+recognizeArchive returns the symbol, archive type and date of an archive from its path.
+Spot and futures trades share the same filename, they are told apart by the directories
+("futures" or "_futures" in the path, as in the trees of the Binance download script).
+*/
+func recognizeArchive(path string) (string, pcommon.ArchiveType, string, bool) {
+	m := archiveFilenameRegexp.FindStringSubmatch(filepath.Base(path))
+	if m == nil {
+		return "", "", "", false
+	}
+	if _, err := pcommon.Format.StrDateToDate(m[3]); err != nil {
+		return "", "", "", false
+	}
+	var t pcommon.ArchiveType
+	switch m[2] {
+	case "trades":
+		t = pcommon.BINANCE_SPOT_TRADES
+		for _, dir := range strings.Split(filepath.ToSlash(filepath.Dir(path)), "/") {
+			if strings.Contains(strings.ToLower(dir), "futures") {
+				t = pcommon.BINANCE_FUTURES_TRADES
+				break
+			}
+		}
+	case "bookDepth":
+		t = pcommon.BINANCE_BOOK_DEPTH
+	case "metrics":
+		t = pcommon.BINANCE_METRICS
+	}
+	return strings.ToUpper(m[1]), t, m[3], true
+}
+
+// setUsesArchiveType returns true if an asset of the set is built from the archive type.
+func setUsesArchiveType(set *pcommon.SetJSON, t pcommon.ArchiveType) bool {
+	for _, asset := range set.Assets {
+		if required := asset.Address.AssetType.GetRequiredArchiveType(); required != nil && *required == t {
+			return true
+		}
+	}
+	return false
+}
+
+// validateArchive checks the .CHECKSUM file (if any) and that the zip holds a single csv file.
+func validateArchive(path string) error {
+	if err := verifyMirrorFile(path); err != nil {
+		return err
+	}
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	count := 0
+	for _, f := range r.File {
+		if filepath.Ext(f.Name) == ".csv" {
+			count++
+		}
+	}
+	if count != 1 {
+		return fmt.Errorf("invalid number of csv files")
+	}
+	return nil
+}
+
+func archiveFragmentsExist(date string, set *pcommon.SetJSON, t pcommon.ArchiveType) bool {
+	for _, asset := range t.GetTargetedAssets() {
+		if !fileExists(set.Settings.BuildArchiveFilePath(asset, date, "zip")) {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *engine) importArchive(path string, sets map[string]*pcommon.SetJSON, mode MirrorMode, dryRun bool) (ImportResult, *pcommon.SetJSON) {
+	res := ImportResult{Path: path, Status: IMPORT_SKIPPED}
+	symbol, t, date, ok := recognizeArchive(path)
+	if !ok {
+		res.Reason = "unrecognized filename"
+		return res, nil
+	}
+	res.ArchiveType = t
+	res.Date = date
+
+	set, ok := sets[symbol]
+	if !ok {
+		res.Reason = "no active set " + symbol
+		return res, nil
+	}
+	res.SetID = set.Settings.IDString()
+	if !setUsesArchiveType(set, t) {
+		res.Reason = "archive type not used by the set"
+		return res, nil
+	}
+
+	res.Destination = t.GetArchiveZipPath(date, set.Settings)
+	if fileExists(res.Destination) || archiveFragmentsExist(date, set, t) {
+		res.Status = IMPORT_EXISTS
+		return res, nil
+	}
+
+	if err := validateArchive(path); err != nil {
+		res.Status = IMPORT_INVALID
+		res.Reason = err.Error()
+		return res, nil
+	}
+
+	res.Status = IMPORT_IMPORTED
+	if dryRun {
+		return res, nil
+	}
+
+	var err error = nil
+	if mode == MIRROR_COPY {
+		err = copyFile(path, res.Destination)
+	} else {
+		err = moveFile(path, res.Destination)
+	}
+	if err == nil {
+		err = storeLocalFile(res.Destination)
+	}
+	if err != nil {
+		res.Status = IMPORT_INVALID
+		res.Reason = err.Error()
+		return res, nil
+	}
+	return res, set
+}
+
+/*
+Import scans dir for Binance archives of the active sets, validates them, places them at their
+archive path and enqueues their fragmenters. With dryRun, the results are only a report.
+*/
+func (e *engine) Import(dir string, mode MirrorMode, dryRun bool) ([]ImportResult, error) {
+	e.mu.RLock()
+	sets := make(map[string]*pcommon.SetJSON, len(e.activeSets))
+	for _, set := range e.activeSets {
+		if err := set.Settings.IsBinancePair(); err == nil {
+			sets[strings.ToUpper(set.Settings.IDString())] = set
+		}
+	}
+	e.mu.RUnlock()
+
+	results := []ImportResult{}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || filepath.Ext(path) != ".zip" {
+			return nil
+		}
+		res, set := e.importArchive(path, sets, mode, dryRun)
+		results = append(results, res)
+		if set != nil {
+			e.Add(buildArchiveFragmenter(res.Date, set, res.ArchiveType))
+		}
+		return nil
+	})
+	if err != nil {
+		return results, err
+	}
+
+	count := 0
+	for _, res := range results {
+		if res.Status == IMPORT_IMPORTED {
+			count++
+		}
+	}
+	log.WithFields(log.Fields{
+		"dir":      dir,
+		"files":    len(results),
+		"imported": count,
+		"dry_run":  dryRun,
+	}).Info("Import done")
+	return results, nil
+}
@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+type MirrorMode string
+
+const (
+	// mirrored archives are moved to the output path (copied then removed across devices)
+	MIRROR_MOVE MirrorMode = "move"
+	// mirrored archives are copied, the mirror is left untouched
+	MIRROR_COPY MirrorMode = "copy"
+)
+
+/*
+Default path templates of the local mirror, relative to MIRROR_DIR (ARCHIVES_DIR by default).
+They match the legacy layout of the archives dropped in ARCHIVES_DIR (<SYMBOL>/_spot, _futures, book_depth, metrics),
+not the tree of the official Binance download script (data/spot/daily/trades/<SYMBOL>/...), which needs MIRROR_TEMPLATES.
+Placeholders: {SYMBOL} (ex: BTCUSDT), {symbol} (ex: btcusdt), {date} (ex: 2024-01-15)
+*/
+var DEFAULT_MIRROR_TEMPLATES = map[pcommon.ArchiveType]string{
+	pcommon.BINANCE_SPOT_TRADES:    "{SYMBOL}/_spot/{SYMBOL}-trades-{date}.zip",
+	pcommon.BINANCE_FUTURES_TRADES: "{SYMBOL}/_futures/{SYMBOL}-trades-{date}.zip",
+	pcommon.BINANCE_BOOK_DEPTH:     "{SYMBOL}/book_depth/{SYMBOL}-bookDepth-{date}.zip",
+	pcommon.BINANCE_METRICS:        "{SYMBOL}/metrics/{SYMBOL}-metrics-{date}.zip",
+}
+
+/*
+parseMirrorTemplates parses a comma separated list of <archive_type>=<path template>
+ex: binance_spot_trades=data/spot/daily/trades/{SYMBOL}/{SYMBOL}-trades-{date}.zip
+*/
+func parseMirrorTemplates(s string) (map[pcommon.ArchiveType]string, error) {
+	templates := map[pcommon.ArchiveType]string{}
+	for t, tmpl := range DEFAULT_MIRROR_TEMPLATES {
+		templates[t] = tmpl
+	}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid mirror template: %s", entry)
+		}
+		t := pcommon.ArchiveType(strings.TrimSpace(kv[0]))
+		if _, ok := pcommon.ArchivesIndex[t]; !ok {
+			return nil, fmt.Errorf("unknown archive type: %s", t)
+		}
+		tmpl := strings.TrimSpace(kv[1])
+		if tmpl != "" && !strings.Contains(tmpl, "{date}") {
+			return nil, fmt.Errorf("mirror template of %s has no {date}", t)
+		}
+		// an empty template disables the mirror for the archive type
+		templates[t] = tmpl
+	}
+	return templates, nil
+}
+
+// getMirrorPath returns where the archive of a date would be in the local mirror, "" if there is no template for the archive type.
+func getMirrorPath(date string, set pcommon.SetSettings, t pcommon.ArchiveType) string {
+	tmpl := Env.MIRROR_TEMPLATES[t]
+	if tmpl == "" || len(set.ID) < 2 {
+		return ""
+	}
+	symbol := set.ID[0] + set.ID[1]
+	path := strings.NewReplacer(
+		"{SYMBOL}", strings.ToUpper(symbol),
+		"{symbol}", strings.ToLower(symbol),
+		"{date}", date,
+	).Replace(tmpl)
+	return filepath.Join(Env.MIRROR_DIR, filepath.FromSlash(path))
+}
+
+// readMirrorChecksum reads the sha256 of the <path>.CHECKSUM file written by the Binance download script ("<sha256>  <filename>"), "" if there is none.
+func readMirrorChecksum(path string) (string, error) {
+	f, err := os.Open(path + ".CHECKSUM")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) > 0 {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("empty checksum file: %s.CHECKSUM", path)
+}
+
+func verifyMirrorFile(path string) error {
+	expected, err := readMirrorChecksum(path)
+	if err != nil {
+		return err
+	}
+	if expected == "" {
+		if Env.MIRROR_REQUIRE_CHECKSUM {
+			return fmt.Errorf("no checksum file for %s", path)
+		}
+		return nil
+	}
+	f, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	if f.SHA256 != expected {
+		return fmt.Errorf("%w: %s (%s != %s)", ErrChecksumMismatch, path, f.SHA256, expected)
+	}
+	return nil
+}
+
+/*
+importFromMirror imports the archive of a date from the local mirror to outputFP.
+It returns false if the archive is not in the mirror (or fails its checksum verification, in which case it is downloaded instead).
+*/
+func importFromMirror(date string, set pcommon.SetSettings, t pcommon.ArchiveType, outputFP string) (bool, error) {
+	path := getMirrorPath(date, set, t)
+	if path == "" {
+		return false, nil
+	}
+	if _, err := os.Stat(path); err != nil {
+		return false, nil
+	}
+
+	if err := verifyMirrorFile(path); err != nil {
+		log.WithFields(log.Fields{
+			"path":  path,
+			"error": err.Error(),
+		}).Warn("Ignoring mirrored archive")
+		return false, nil
+	}
+
+	if Env.MIRROR_MODE == MIRROR_COPY {
+		if err := copyFile(path, outputFP); err != nil {
+			return false, err
+		}
+	} else {
+		if err := moveFile(path, outputFP); err != nil {
+			return false, err
+		}
+		os.Remove(path + ".CHECKSUM")
+	}
+	return true, storeLocalFile(outputFP)
+}
@@ -0,0 +1,46 @@
+//go:build !windows
+
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+// kept open while the process runs: the lock is released when the process exits
+var engineLock *os.File = nil
+
+func getEngineLockPath() string {
+	return filepath.Join(pcommon.Env.ARCHIVES_DIR, "__engine.lock")
+}
+
+/*
+lockEngine takes an exclusive lock on ARCHIVES_DIR, so that only one process runs runners on it: two engines would
+download and fragment the same archives, and overwrite each other's state, tiering index and partial files.
+*/
+func lockEngine() error {
+	if engineLock != nil {
+		return nil
+	}
+	if err := pcommon.File.EnsureDir(pcommon.Env.ARCHIVES_DIR); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(getEngineLockPath(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return fmt.Errorf("another archiver (daemon or command) is running on %s", pcommon.Env.ARCHIVES_DIR)
+		}
+		return err
+	}
+	engineLock = f
+	return nil
+}
@@ -0,0 +1,6 @@
+package engine
+
+// flock is not available on windows, the engine is not locked.
+func lockEngine() error {
+	return nil
+}
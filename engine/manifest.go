@@ -0,0 +1,188 @@
+package engine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+// FragmentManifest describes the fragments built from one raw archive.
+type FragmentManifest struct {
+	SetID       string              `json:"set_id"`
+	ArchiveType pcommon.ArchiveType `json:"archive_type"`
+	Date        string              `json:"date"`
+	CreatedAt   int64               `json:"created_at"`
+	Source      ManifestFile        `json:"source"`
+	// publication the source has been downloaded from, nil if imported
+	Remote *RemoteArchive `json:"remote,omitempty"`
+	// set if the fragments replace the ones of a previous publication of the source
+	Republished *RepublishedArchive `json:"republished,omitempty"`
+	Fragments   []ManifestFragment  `json:"fragments"`
+}
+
+type ManifestFile struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type ManifestFragment struct {
+	ManifestFile
+	Asset   pcommon.AssetType `json:"asset"`
+	Rows    int64             `json:"rows"`
+	MinTime pcommon.TimeUnit  `json:"min_time"`
+	MaxTime pcommon.TimeUnit  `json:"max_time"`
+}
+
+// addRow counts a row of the fragment and extends its time bounds.
+func (f *ManifestFragment) addRow(timeStr string) {
+	f.Rows++
+	if tu := pcommon.NewTimeUnitFromIntString(timeStr); tu > 0 {
+		if f.MinTime == 0 || tu < f.MinTime {
+			f.MinTime = tu
+		}
+		if tu > f.MaxTime {
+			f.MaxTime = tu
+		}
+	}
+}
+
+func getManifestPath(date string, set pcommon.SetSettings, t pcommon.ArchiveType) string {
+	return filepath.Join(
+		pcommon.Env.ARCHIVES_DIR,
+		strings.ToUpper(set.IDString()),
+		"__manifests",
+		string(t),
+		fmt.Sprintf("%s.json", date),
+	)
+}
+
+func hashReader(fp string, r io.Reader) (*ManifestFile, error) {
+	h := sha256.New()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+	return &ManifestFile{
+		Path:   fp,
+		Size:   size,
+		SHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+func hashFile(fp string) (*ManifestFile, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return hashReader(fp, f)
+}
+
+// hashStoredFile hashes a file of the output storage.
+func hashStoredFile(fp string) (*ManifestFile, error) {
+	body, err := Output.Get(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return hashReader(fp, body)
+}
+
+func buildFragmentManifest(date string, set *pcommon.SetJSON, t pcommon.ArchiveType, fragments []ManifestFragment) (*FragmentManifest, error) {
+	source, err := hashFile(t.GetArchiveZipPath(date, set.Settings))
+	if err != nil {
+		return nil, err
+	}
+	remote, err := ReadRemoteArchive(date, set.Settings, t)
+	if err != nil {
+		return nil, err
+	}
+	republished, err := ReadRepublishedArchive(date, set.Settings, t)
+	if err != nil {
+		return nil, err
+	}
+	for i := range fragments {
+		f, err := hashFile(fragments[i].Path)
+		if err != nil {
+			return nil, err
+		}
+		fragments[i].ManifestFile = *f
+	}
+	return &FragmentManifest{
+		SetID:       set.Settings.IDString(),
+		ArchiveType: t,
+		Date:        date,
+		CreatedAt:   time.Now().UnixMilli(),
+		Source:      *source,
+		Remote:      remote,
+		Republished: republished,
+		Fragments:   fragments,
+	}, nil
+}
+
+func (m *FragmentManifest) Paths() []string {
+	paths := make([]string, len(m.Fragments))
+	for i, f := range m.Fragments {
+		paths[i] = f.Path
+	}
+	return paths
+}
+
+func (m *FragmentManifest) Write(set pcommon.SetSettings) error {
+	fp := getManifestPath(m.Date, set, m.ArchiveType)
+	if err := pcommon.File.EnsureDir(filepath.Dir(fp)); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fp, data, 0644)
+}
+
+// ReadFragmentManifest returns nil without error if no manifest has been written for this archive.
+func ReadFragmentManifest(date string, set pcommon.SetSettings, t pcommon.ArchiveType) (*FragmentManifest, error) {
+	data, err := os.ReadFile(getManifestPath(date, set, t))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	m := FragmentManifest{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// Verify checks the fragments (and the source archive if withSource) match the manifest.
+func (m *FragmentManifest) Verify(withSource bool) error {
+	files := []ManifestFile{}
+	if withSource {
+		files = append(files, m.Source)
+	}
+	for _, f := range m.Fragments {
+		files = append(files, f.ManifestFile)
+	}
+
+	for _, expected := range files {
+		f, err := hashStoredFile(expected.Path)
+		if err != nil {
+			return err
+		}
+		if f.Size != expected.Size || f.SHA256 != expected.SHA256 {
+			return fmt.Errorf("%s does not match its manifest", expected.Path)
+		}
+	}
+	return nil
+}
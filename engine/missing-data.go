@@ -0,0 +1,246 @@
+package engine
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+// MissingProbe is the answer of a host to a request made to tell whether an archive is missing.
+type MissingProbe struct {
+	URL        string `json:"url"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+func newMissingProbe(url string, err error) MissingProbe {
+	p := MissingProbe{URL: url, StatusCode: 200}
+	if err != nil {
+		p.StatusCode = 0
+		p.Error = err.Error()
+		var httpErr *HTTPError
+		if errors.As(err, &httpErr) {
+			p.StatusCode = httpErr.StatusCode
+		}
+	}
+	return p
+}
+
+/*
+MissingData records an archive the server does not publish although the days around it are published
+(the archive of the first date of the asset history is probed as a reference).
+It replaces the empty archive that used to be created, which could not be told apart from a day without data.
+*/
+type MissingData struct {
+	SetID       string              `json:"set_id"`
+	ArchiveType pcommon.ArchiveType `json:"archive_type"`
+	Date        string              `json:"date"`
+	Assets      []pcommon.AssetType `json:"assets"`
+	Reason      string              `json:"reason"`
+	Probes      []MissingProbe      `json:"probes"`
+	DetectedAt  int64               `json:"detected_at"`
+	CheckedAt   int64               `json:"checked_at"`
+	Checks      int                 `json:"checks"`
+	// false until the parser acknowledged the missing data
+	Notified bool `json:"notified"`
+}
+
+func getMissingDataPath(date string, set pcommon.SetSettings, t pcommon.ArchiveType) string {
+	return filepath.Join(getMissingDataDir(set, t), fmt.Sprintf("%s.json", date))
+}
+
+func getMissingDataDir(set pcommon.SetSettings, t pcommon.ArchiveType) string {
+	return filepath.Join(
+		pcommon.Env.ARCHIVES_DIR,
+		strings.ToUpper(set.IDString()),
+		"__missing",
+		string(t),
+	)
+}
+
+// ReadMissingData returns nil without error if the archive is not recorded as missing.
+func ReadMissingData(date string, set pcommon.SetSettings, t pcommon.ArchiveType) (*MissingData, error) {
+	data, err := os.ReadFile(getMissingDataPath(date, set, t))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	m := MissingData{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// serializes the read-modify-write of the missing data records (downloaders, recheck and notification loop)
+var missingDataMu sync.Mutex
+
+func (m *MissingData) write(set pcommon.SetSettings) error {
+	fp := getMissingDataPath(m.Date, set, m.ArchiveType)
+	if err := pcommon.File.EnsureDir(filepath.Dir(fp)); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fp, data, 0644)
+}
+
+/*
+recordMissingData writes the missing data record of an archive (keeping its detection time if it was already recorded).
+The parser is notified by the missing data loop only.
+*/
+func (e *engine) recordMissingData(date string, set *pcommon.SetJSON, t pcommon.ArchiveType, reason string, probes []MissingProbe) error {
+	now := time.Now().UnixMilli()
+	m := &MissingData{
+		SetID:       set.Settings.IDString(),
+		ArchiveType: t,
+		Date:        date,
+		Assets:      t.GetTargetedAssets(),
+		Reason:      reason,
+		Probes:      probes,
+		DetectedAt:  now,
+		CheckedAt:   now,
+		Checks:      1,
+	}
+	missingDataMu.Lock()
+	if previous, _ := ReadMissingData(date, set.Settings, t); previous != nil {
+		m.DetectedAt = previous.DetectedAt
+		m.Checks = previous.Checks + 1
+		m.Notified = previous.Notified
+	}
+	err := m.write(set.Settings)
+	missingDataMu.Unlock()
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"set":    m.SetID,
+		"type":   t,
+		"date":   date,
+		"reason": reason,
+	}).Warn("Archive missing on the server")
+	return nil
+}
+
+// markMissingDataNotified sets the notified flag of the current record of an archive, if it is still recorded as missing.
+func markMissingDataNotified(set pcommon.SetSettings, date string, t pcommon.ArchiveType) error {
+	missingDataMu.Lock()
+	defer missingDataMu.Unlock()
+	m, err := ReadMissingData(date, set, t)
+	if err != nil || m == nil {
+		return err
+	}
+	m.Notified = true
+	return m.write(set)
+}
+
+// ListMissingData returns the missing data records of the active sets.
+func (e *engine) ListMissingData() []MissingData {
+	e.mu.RLock()
+	sets := make([]*pcommon.SetJSON, 0, len(e.activeSets))
+	for _, set := range e.activeSets {
+		sets = append(sets, set)
+	}
+	e.mu.RUnlock()
+
+	list := []MissingData{}
+	for _, set := range sets {
+		for _, t := range pcommon.ARCHIVE_TYPE_LIST {
+			entries, err := os.ReadDir(getMissingDataDir(set.Settings, t))
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				date := strings.TrimSuffix(entry.Name(), ".json")
+				if m, err := ReadMissingData(date, set.Settings, t); err == nil && m != nil {
+					list = append(list, *m)
+				}
+			}
+		}
+	}
+	return list
+}
+
+/*
+recheckMissingData probes again the hosts of a missing archive. Once it is published, the record is replaced by
+a republished mark, so the archive is downloaded, fragmented and ingested again by the parser. The downloader that recorded
+the missing data is done by then: it is run again through Held.rerun (see refetchArchive).
+*/
+func (e *engine) recheckMissingData(set *pcommon.SetJSON, m *MissingData) error {
+	url, err := m.ArchiveType.GetURL(m.Date, set.Settings)
+	if err != nil {
+		return err
+	}
+	probes := []MissingProbe{}
+	var found *RemoteArchive = nil
+	for _, u := range Mirrors.orderByHealth(Mirrors.candidateURLs(m.ArchiveType, url)) {
+		remote, err := preflight(u, func() bool { return e.IsShuttingDown() })
+		probes = append(probes, newMissingProbe(u, err))
+		if err == nil {
+			found = remote
+			if found == nil {
+				found = &RemoteArchive{URL: u}
+			}
+			break
+		}
+	}
+	if found == nil {
+		return e.recordMissingData(m.Date, set, m.ArchiveType, m.Reason, probes)
+	}
+
+	republished := &RepublishedArchive{
+		SetID:       m.SetID,
+		ArchiveType: m.ArchiveType,
+		Date:        m.Date,
+		Assets:      m.Assets,
+		Reason:      "published after being missing",
+		Current:     found,
+	}
+	missingDataMu.Lock()
+	os.Remove(getMissingDataPath(m.Date, set.Settings, m.ArchiveType))
+	missingDataMu.Unlock()
+	return e.refetchArchive(set, republished)
+}
+
+// RunMissingDataLoop probes the missing archives again every MISSING_DATA_RECHECK_INTERVAL, and notifies the parser of the records it has not acknowledged yet.
+func (e *engine) RunMissingDataLoop() {
+	for !e.IsShuttingDown() {
+		time.Sleep(SET_POLLING_INTERVAL)
+		for _, m := range e.ListMissingData() {
+			if e.IsShuttingDown() {
+				return
+			}
+			e.mu.RLock()
+			set, ok := e.activeSets[m.SetID]
+			e.mu.RUnlock()
+			if !ok {
+				continue
+			}
+			m := m
+			if Env.MISSING_DATA_RECHECK_INTERVAL > 0 && time.Since(time.UnixMilli(m.CheckedAt)) >= Env.MISSING_DATA_RECHECK_INTERVAL {
+				if err := e.recheckMissingData(set, &m); err != nil {
+					log.WithFields(log.Fields{
+						"set":   m.SetID,
+						"type":  m.ArchiveType,
+						"date":  m.Date,
+						"error": err.Error(),
+					}).Warn("Failed to recheck missing archive")
+				}
+			} else if !m.Notified {
+				e.notifyDataMissing(set.Settings, &m)
+			}
+		}
+	}
+}
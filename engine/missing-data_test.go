@@ -0,0 +1,49 @@
+package engine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+func TestRecheckPublishedMissingData(t *testing.T) {
+	pcommon.Env.ARCHIVES_DIR = t.TempDir()
+	useTestEngine(t, false)
+
+	// a mirror now publishing the archive
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "42")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	previousClient, previousMirrors := downloadClient, Env.DOWNLOAD_MIRRORS_GLOBAL
+	downloadClient, Env.DOWNLOAD_MIRRORS_GLOBAL = server.Client(), []string{server.URL}
+	defer func() { downloadClient, Env.DOWNLOAD_MIRRORS_GLOBAL = previousClient, previousMirrors }()
+
+	set := testSet(time.Minute, 3)
+	date := "2024-01-15"
+	at := pcommon.BINANCE_SPOT_TRADES
+	if err := Engine.recordMissingData(date, &set, at, "not found", nil); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadMissingData(date, set.Settings, at)
+	if err != nil || m == nil {
+		t.Fatalf("missing data not recorded: %v", err)
+	}
+
+	defer Engine.StopSetRunners(&set)
+	if err := Engine.recheckMissingData(&set, m); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := ReadMissingData(date, set.Settings, at); m != nil {
+		t.Fatal("missing data kept once published")
+	}
+	if r, _ := ReadRepublishedArchive(date, set.Settings, at); r == nil || r.Current == nil || r.Current.Size != 42 {
+		t.Fatalf("published archive not marked republished: %+v", r)
+	}
+	// the downloader that recorded the missing data is done: it must run again anyway
+	waitQueued(t, 1)
+}
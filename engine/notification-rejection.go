@@ -0,0 +1,97 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+/*
+NotificationRejection records the rejections of the fragments of an archive by the parser, until it accepts them
+or a new manifest replaces them. The notification is sent again according to the rejected retry policy, apart from
+the transport failures which are retried every minute.
+*/
+type NotificationRejection struct {
+	Reason   string `json:"reason"`
+	Attempts int    `json:"attempts"`
+	At       int64  `json:"at"`
+	// next notification (unix ms)
+	RetryAt int64 `json:"retry_at,omitempty"`
+	// the notification won't be sent again until the archive is fragmented again
+	GaveUp bool `json:"gave_up"`
+}
+
+func getNotificationRejectionPath(date string, setID string, t pcommon.ArchiveType) string {
+	return filepath.Join(
+		pcommon.Env.ARCHIVES_DIR,
+		strings.ToUpper(setID),
+		"__rejected",
+		string(t),
+		fmt.Sprintf("%s.json", date),
+	)
+}
+
+// readNotificationRejection returns nil without error if the parser did not reject the manifest.
+func readNotificationRejection(m *FragmentManifest) (*NotificationRejection, error) {
+	data, err := os.ReadFile(getNotificationRejectionPath(m.Date, m.SetID, m.ArchiveType))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	r := &NotificationRejection{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// recordNotificationRejection counts a rejection of the manifest and schedules the next notification, or gives up after the max attempts.
+func recordNotificationRejection(m *FragmentManifest, reason string) (*NotificationRejection, error) {
+	previous, err := readNotificationRejection(m)
+	if err != nil {
+		return nil, err
+	}
+	policy, ok := Env.RETRY_POLICIES[RETRY_CLASS_REJECTED]
+	if !ok {
+		policy = DEFAULT_RETRY_POLICIES[RETRY_CLASS_REJECTED]
+	}
+	r := &NotificationRejection{
+		Reason:   reason,
+		Attempts: 1,
+		At:       time.Now().UnixMilli(),
+	}
+	if previous != nil {
+		r.Attempts = previous.Attempts + 1
+	}
+	if r.Attempts >= policy.MaxAttempts {
+		r.GaveUp = true
+	} else {
+		r.RetryAt = time.Now().Add(policy.delay(r.Attempts)).UnixMilli()
+	}
+
+	fp := getNotificationRejectionPath(m.Date, m.SetID, m.ArchiveType)
+	if err := pcommon.File.EnsureDir(filepath.Dir(fp)); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return r, os.WriteFile(fp, data, 0644)
+}
+
+// clearNotificationRejection removes the rejections of an archive (accepted by the parser, or fragmented again).
+func clearNotificationRejection(date string, setID string, t pcommon.ArchiveType) error {
+	err := os.Remove(getNotificationRejectionPath(date, setID, t))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
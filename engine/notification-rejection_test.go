@@ -0,0 +1,53 @@
+package engine
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+func TestNotificationRejectionRetries(t *testing.T) {
+	pcommon.Env.ARCHIVES_DIR = t.TempDir()
+	previous := Env.RETRY_POLICIES
+	Env.RETRY_POLICIES = map[string]RetryPolicy{RETRY_CLASS_REJECTED: {Base: time.Hour, Max: time.Hour, MaxAttempts: 2}}
+	t.Cleanup(func() { Env.RETRY_POLICIES = previous })
+
+	m := &FragmentManifest{SetID: "btcusdt", ArchiveType: pcommon.BINANCE_SPOT_TRADES, Date: "2024-01-15"}
+	r, err := recordNotificationRejection(m, "set not ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Attempts != 1 || r.GaveUp || time.Until(time.UnixMilli(r.RetryAt)) < 30*time.Minute {
+		t.Fatalf("first rejection %+v", r)
+	}
+
+	// waiting for its next attempt: not sent by the notification loop
+	useTestEngine(t, false)
+	Engine.pendingNotifications.add(m)
+	Engine.flushPendingNotifications()
+	if len(Engine.pendingNotifications.all(true)) != 1 {
+		t.Fatal("rejected manifest should stay pending until its next attempt")
+	}
+
+	r, err = recordNotificationRejection(m, "set not ready")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Attempts != 2 || !r.GaveUp {
+		t.Fatalf("second rejection %+v should give up", r)
+	}
+	Engine.flushPendingNotifications()
+	if len(Engine.pendingNotifications.all(true)) != 0 {
+		t.Fatal("manifest rejected too many times should not be pending anymore")
+	}
+
+	// fragmented again: the record is cleared
+	if err := clearNotificationRejection(m.Date, m.SetID, m.ArchiveType); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(getNotificationRejectionPath(m.Date, m.SetID, m.ArchiveType)); !os.IsNotExist(err) {
+		t.Fatal("rejection record kept")
+	}
+}
@@ -0,0 +1,260 @@
+package engine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+type FragmentsReadyResponse struct {
+	Accepted bool   `json:"accepted"`
+	Reason   string `json:"reason"`
+}
+
+/*
+manifests the parser hasn't accepted yet (being sent, disconnected, timed out or rejected), sent again by the notification loop.
+A manifest is added before being sent and kept until the parser accepts it, so the persisted state never misses one.
+*/
+type pendingNotifications struct {
+	list map[string]*FragmentManifest
+	// being sent, skipped by the notification loop
+	sending map[string]bool
+	mu      sync.Mutex
+}
+
+func notificationKey(m *FragmentManifest) string {
+	return fmt.Sprintf("%s-%s-%s", m.SetID, m.Date, m.ArchiveType)
+}
+
+func (p *pendingNotifications) add(m *FragmentManifest) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.list == nil {
+		p.list = make(map[string]*FragmentManifest)
+	}
+	p.list[notificationKey(m)] = m
+}
+
+// send adds m and marks it being sent, it returns false if a manifest of the same archive is already being sent (m is sent by the loop then).
+func (p *pendingNotifications) send(m *FragmentManifest) bool {
+	p.add(m)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := notificationKey(m)
+	if p.sending[key] {
+		return false
+	}
+	if p.sending == nil {
+		p.sending = make(map[string]bool)
+	}
+	p.sending[key] = true
+	return true
+}
+
+// sent unmarks m, and forgets it if the parser accepted it (unless a newer manifest of the archive has been added meanwhile).
+func (p *pendingNotifications) sent(m *FragmentManifest, accepted bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := notificationKey(m)
+	delete(p.sending, key)
+	if accepted && p.list[key] == m {
+		delete(p.list, key)
+	}
+}
+
+// all returns the pending manifests, being sent or not if sending.
+func (p *pendingNotifications) all(sending bool) []*FragmentManifest {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	list := make([]*FragmentManifest, 0, len(p.list))
+	for key, m := range p.list {
+		if sending || !p.sending[key] {
+			list = append(list, m)
+		}
+	}
+	return list
+}
+
+func requestFragmentsReady(client *pcommon.RPCClient, m *FragmentManifest) (*FragmentsReadyResponse, error) {
+	if err := client.CheckConnectedError(); err != nil {
+		return nil, err
+	}
+
+	manifest, err := pcommon.Format.EncodeStructIntoMap(m)
+	if err != nil {
+		return nil, err
+	}
+
+	CountRPCRequests++
+	res, err := withRPCTimeout("FragmentsReady", func() (*pcommon.RPCResponse, error) {
+		return client.Request("FragmentsReady", pcommon.RPCRequestPayload{
+			"set_id":       m.SetID,
+			"archive_type": m.ArchiveType,
+			"date":         m.Date,
+			"paths":        m.Paths(),
+			"republished":  m.Republished != nil,
+			"manifest":     manifest,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := FragmentsReadyResponse{}
+	if err := pcommon.Format.DecodeMapIntoStruct(res.Data, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// notifyFragmentsReady tells the parser the fragments of an archive are ready to be ingested.
+func (e *engine) notifyFragmentsReady(m *FragmentManifest) {
+	if e.client == nil {
+		return
+	}
+	fields := log.Fields{
+		"set":  m.SetID,
+		"type": m.ArchiveType,
+		"date": m.Date,
+	}
+
+	if !e.pendingNotifications.send(m) {
+		e.persistState()
+		return
+	}
+	e.persistState()
+
+	res, err := requestFragmentsReady(e.client, m)
+	if err != nil {
+		e.pendingNotifications.sent(m, false)
+		fields["error"] = err.Error()
+		log.WithFields(fields).Warn("Failed to notify parser of ready fragments, will retry")
+		return
+	}
+
+	if !res.Accepted {
+		e.onFragmentsRejected(m, res.Reason, fields)
+		return
+	}
+	e.pendingNotifications.sent(m, true)
+	e.persistState()
+	if err := clearNotificationRejection(m.Date, m.SetID, m.ArchiveType); err != nil {
+		fields["error"] = err.Error()
+		log.WithFields(fields).Warn("Failed to remove rejected notification record")
+	}
+	log.WithFields(fields).Info("Parser acknowledged fragments")
+}
+
+// onFragmentsRejected keeps a rejected manifest pending until its next attempt (set not ready yet...), and drops it once the parser rejected it too many times.
+func (e *engine) onFragmentsRejected(m *FragmentManifest, reason string, fields log.Fields) {
+	fields["reason"] = reason
+	rejection, err := recordNotificationRejection(m, reason)
+	if err != nil {
+		// without record, the manifest is sent again by the next flush
+		e.pendingNotifications.sent(m, false)
+		fields["error"] = err.Error()
+		log.WithFields(fields).Error("Parser rejected fragments, failed to record the rejection")
+		return
+	}
+	fields["attempts"] = rejection.Attempts
+	if rejection.GaveUp {
+		e.pendingNotifications.sent(m, true)
+		e.persistState()
+		log.WithFields(fields).Error("Parser rejected fragments too many times, giving up")
+		return
+	}
+	e.pendingNotifications.sent(m, false)
+	fields["retry_in"] = pcommon.Format.AccurateHumanize(time.Until(time.UnixMilli(rejection.RetryAt)))
+	log.WithFields(fields).Warn("Parser rejected fragments, will retry")
+}
+
+// flushPendingNotifications sends again the pending manifests, but the rejected ones waiting for their next attempt.
+func (e *engine) flushPendingNotifications() {
+	for _, m := range e.pendingNotifications.all(false) {
+		rejection, err := readNotificationRejection(m)
+		if err == nil && rejection != nil {
+			if rejection.GaveUp {
+				// restored with the state of a process that did not see the last rejection
+				e.pendingNotifications.sent(m, true)
+				continue
+			}
+			if time.Now().UnixMilli() < rejection.RetryAt {
+				continue
+			}
+		}
+		e.notifyFragmentsReady(m)
+	}
+}
+
+// RunNotificationLoop sends again the pending notifications every SET_POLLING_INTERVAL, apart from the refresh loop so a parser not answering does not stop the set refreshes.
+func (e *engine) RunNotificationLoop() {
+	for !e.IsShuttingDown() {
+		time.Sleep(SET_POLLING_INTERVAL)
+		e.flushPendingNotifications()
+	}
+}
+
+func requestDataMissing(client *pcommon.RPCClient, m *MissingData) (*FragmentsReadyResponse, error) {
+	if err := client.CheckConnectedError(); err != nil {
+		return nil, err
+	}
+
+	missing, err := pcommon.Format.EncodeStructIntoMap(m)
+	if err != nil {
+		return nil, err
+	}
+
+	CountRPCRequests++
+	res, err := withRPCTimeout("DataMissing", func() (*pcommon.RPCResponse, error) {
+		return client.Request("DataMissing", pcommon.RPCRequestPayload{
+			"set_id":       m.SetID,
+			"archive_type": m.ArchiveType,
+			"date":         m.Date,
+			"assets":       m.Assets,
+			"missing":      missing,
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret := FragmentsReadyResponse{}
+	if err := pcommon.Format.DecodeMapIntoStruct(res.Data, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// notifyDataMissing tells the parser an archive is missing on the server, it is called by the missing data loop only, until the parser answers.
+func (e *engine) notifyDataMissing(set pcommon.SetSettings, m *MissingData) {
+	if e.client == nil {
+		return
+	}
+	fields := log.Fields{
+		"set":  m.SetID,
+		"type": m.ArchiveType,
+		"date": m.Date,
+	}
+
+	res, err := requestDataMissing(e.client, m)
+	if err != nil {
+		fields["error"] = err.Error()
+		log.WithFields(fields).Warn("Failed to notify parser of missing data, will retry")
+		return
+	}
+
+	if !res.Accepted {
+		fields["reason"] = res.Reason
+		log.WithFields(fields).Error("Parser rejected missing data")
+	} else {
+		log.WithFields(fields).Info("Parser acknowledged missing data")
+	}
+	// the record may have been updated (or removed) meanwhile
+	if err := markMissingDataNotified(set, m.Date, m.ArchiveType); err != nil {
+		fields["error"] = err.Error()
+		log.WithFields(fields).Warn("Failed to save missing data record")
+	}
+}
@@ -0,0 +1,160 @@
+package engine
+
+import (
+	"os"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+type PlannedRunnerKind string
+
+const (
+	PLAN_DOWNLOAD PlannedRunnerKind = "download"
+	PLAN_FRAGMENT PlannedRunnerKind = "fragment"
+)
+
+// PlannedRunner is a runner the refresh would queue.
+type PlannedRunner struct {
+	ID          string              `json:"id"`
+	Kind        PlannedRunnerKind   `json:"kind"`
+	SetID       string              `json:"set_id"`
+	ArchiveType pcommon.ArchiveType `json:"archive_type"`
+	Date        string              `json:"date"`
+	// url of the first mirror to download from, or path of the archive in the local mirror
+	Source string `json:"source,omitempty"`
+	// size of the download (HEAD request or local mirror), disk space needed by a fragmenter; 0 if unknown
+	EstimatedBytes int64  `json:"estimated_bytes"`
+	Error          string `json:"error,omitempty"`
+}
+
+type SetPlanError struct {
+	SetID string `json:"set_id"`
+	Error string `json:"error"`
+}
+
+type RefreshPlan struct {
+	Runners       []PlannedRunner `json:"runners"`
+	Errors        []SetPlanError  `json:"errors"`
+	DownloadBytes int64           `json:"download_bytes"`
+	FragmentBytes int64           `json:"fragment_bytes"`
+}
+
+// planDownload returns the downloader the refresh would queue for the archive of a date, nil if the downloader would skip it.
+func planDownload(date string, set *pcommon.SetJSON, t pcommon.ArchiveType, withHEAD bool) *PlannedRunner {
+	r := &PlannedRunner{
+		ID:          downloaderID(date, set.Settings, t),
+		Kind:        PLAN_DOWNLOAD,
+		SetID:       set.Settings.IDString(),
+		ArchiveType: t,
+		Date:        date,
+	}
+	reason, err := downloadSkipReason(date, set, t)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	if reason != "" {
+		return nil
+	}
+
+	if path := getMirrorPath(date, set.Settings, t); path != "" {
+		if stat, err := os.Stat(path); err == nil {
+			r.Source = path
+			r.EstimatedBytes = stat.Size()
+			return r
+		}
+	}
+
+	url, err := t.GetURL(date, set.Settings)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.Source = Mirrors.orderByHealth(Mirrors.candidateURLs(t, url))[0]
+	if withHEAD {
+		remote, err := preflight(r.Source, func() bool { return false })
+		if err != nil {
+			r.Error = err.Error()
+		} else if remote != nil {
+			r.EstimatedBytes = remote.Size
+		}
+	}
+	return r
+}
+
+/*
+PlanRefresh returns the runners a refresh would queue (see handleSet), without queuing them nor writing anything.
+The active sets are fetched from the provider but not replaced. With withHEAD, the size of each download is
+requested to its first mirror.
+*/
+func (e *engine) PlanRefresh(withHEAD bool) (*RefreshPlan, error) {
+	minTimeframe := e.getMinTimeframe()
+	if minTimeframe == 0 {
+		tf, err := e.provider.FetchMinTimeframe()
+		if err != nil {
+			return nil, err
+		}
+		minTimeframe = tf
+	}
+	sets, err := e.provider.FetchSetList()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &RefreshPlan{Runners: []PlannedRunner{}, Errors: []SetPlanError{}}
+	for i := range sets {
+		set := &sets[i]
+		if err := set.Settings.IsValid(); err != nil {
+			plan.Errors = append(plan.Errors, SetPlanError{SetID: set.Settings.IDString(), Error: err.Error()})
+			continue
+		}
+		scheduled := scheduledArchives(set, minTimeframe)
+
+		checked := map[pcommon.ArchiveType]bool{}
+		valid := true
+		for _, v := range scheduled {
+			t := pcommon.ArchiveType(v[0])
+			if !checked[t] {
+				if _, err := t.GetURL(v[1], set.Settings); err != nil {
+					plan.Errors = append(plan.Errors, SetPlanError{SetID: set.Settings.IDString(), Error: err.Error()})
+					valid = false
+					break
+				}
+				checked[t] = true
+			}
+		}
+		if !valid {
+			continue
+		}
+
+		for _, v := range scheduled {
+			t, date := pcommon.ArchiveType(v[0]), v[1]
+			needed, err := needsFragmenter(date, set, t)
+			if !needed && err == nil {
+				continue
+			}
+			r := PlannedRunner{
+				ID:          fragmenterID(date, set.Settings, t),
+				Kind:        PLAN_FRAGMENT,
+				SetID:       set.Settings.IDString(),
+				ArchiveType: t,
+				Date:        date,
+			}
+			if err != nil {
+				r.Error = err.Error()
+			} else {
+				r.EstimatedBytes, _ = estimateFragmenterSpace(t.GetArchiveZipPath(date, set.Settings))
+				plan.FragmentBytes += r.EstimatedBytes
+			}
+			plan.Runners = append(plan.Runners, r)
+		}
+		for _, v := range scheduled {
+			t, date := pcommon.ArchiveType(v[0]), v[1]
+			if r := planDownload(date, set, t, withHEAD); r != nil {
+				plan.DownloadBytes += r.EstimatedBytes
+				plan.Runners = append(plan.Runners, *r)
+			}
+		}
+	}
+	return plan, nil
+}
@@ -0,0 +1,135 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+// RemoteArchive is what a download host tells about an archive in the headers of a HEAD request.
+type RemoteArchive struct {
+	URL  string `json:"url"`
+	Size int64  `json:"size"`
+	ETag string `json:"etag"`
+	// unix milliseconds, 0 if the header is missing
+	LastModified int64 `json:"last_modified"`
+	AcceptRanges bool  `json:"accept_ranges"`
+	CheckedAt    int64 `json:"checked_at"`
+}
+
+// sameContent returns true if both archives are the same publication: same ETag if both have one, same size and Last-Modified otherwise.
+func (r *RemoteArchive) sameContent(o *RemoteArchive) bool {
+	if r.ETag != "" && o.ETag != "" {
+		return r.ETag == o.ETag
+	}
+	return r.Size == o.Size && r.LastModified == o.LastModified
+}
+
+/*
+preflight sends a HEAD request of url. A missing archive returns an ErrFileNotFound without downloading anything.
+It returns nil without error if the host does not support HEAD requests.
+*/
+func preflight(url string, interruptionCheck func() bool) (*RemoteArchive, error) {
+	if err := RateLimiter.wait(url, interruptionCheck); err != nil {
+		return nil, err
+	}
+	resp, err := downloadClient.Head(url)
+	if err != nil {
+		return nil, newNetworkError(url, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, failedResponseError(url, resp)
+	}
+	RateLimiter.success(url)
+
+	remote := &RemoteArchive{
+		URL:          url,
+		Size:         resp.ContentLength,
+		ETag:         strings.TrimPrefix(resp.Header.Get("ETag"), "W/"),
+		AcceptRanges: resp.Header.Get("Accept-Ranges") == "bytes",
+		CheckedAt:    time.Now().UnixMilli(),
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		remote.LastModified = lastModified.UnixMilli()
+	}
+	return remote, nil
+}
+
+// getRemoteArchivePath returns where the RemoteArchive of the last download of an archive is recorded.
+func getRemoteArchivePath(date string, set pcommon.SetSettings, t pcommon.ArchiveType) string {
+	return filepath.Join(
+		pcommon.Env.ARCHIVES_DIR,
+		strings.ToUpper(set.IDString()),
+		"__remote",
+		string(t),
+		fmt.Sprintf("%s.json", date),
+	)
+}
+
+func writeRemoteArchive(fp string, remote *RemoteArchive) error {
+	if err := pcommon.File.EnsureDir(filepath.Dir(fp)); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(remote, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fp, data, 0644)
+}
+
+// readRemoteArchive returns nil without error if nothing has been recorded at fp.
+func readRemoteArchive(fp string) (*RemoteArchive, error) {
+	data, err := os.ReadFile(fp)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	remote := RemoteArchive{}
+	if err := json.Unmarshal(data, &remote); err != nil {
+		return nil, err
+	}
+	return &remote, nil
+}
+
+// ReadRemoteArchive returns nil without error if the archive has not been downloaded (or has been imported).
+func ReadRemoteArchive(date string, set pcommon.SetSettings, t pcommon.ArchiveType) (*RemoteArchive, error) {
+	return readRemoteArchive(getRemoteArchivePath(date, set, t))
+}
+
+/*
+preparePartialDownload discards the partial files of outputFilePath if they were downloaded from another mirror than url,
+or from another publication of the archive than remote (nil if the mirror does not support HEAD requests): resuming them
+would mix both. It then records url and remote as their origin.
+*/
+func preparePartialDownload(outputFilePath string, url string, remote *RemoteArchive) error {
+	fp := outputFilePath + ".part.json"
+	previous, err := readRemoteArchive(fp)
+	if err != nil {
+		return err
+	}
+	if remote == nil {
+		remote = &RemoteArchive{URL: url, CheckedAt: time.Now().UnixMilli()}
+	}
+	if previous != nil && (previous.URL != url || !previous.sameContent(remote)) {
+		log.WithFields(log.Fields{
+			"path": outputFilePath,
+			"url":  url,
+		}).Info("Partial download comes from another mirror or publication, restarting it")
+		os.Remove(outputFilePath + ".part")
+		removeSegments(outputFilePath, findSegments(outputFilePath))
+	}
+	return writeRemoteArchive(fp, remote)
+}
@@ -0,0 +1,239 @@
+package engine
+
+import (
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fantasim/gorunner"
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+// the request rate of a host is divided by RATE_LIMIT_DECREASE_FACTOR on each 429 and increased by RATE_LIMIT_INCREASE on each success
+const RATE_LIMIT_DECREASE_FACTOR = 2
+const RATE_LIMIT_INCREASE = 0.1
+const RATE_LIMIT_MIN = 0.05
+
+// hostLimiter is a token bucket of the requests sent to a host.
+type hostLimiter struct {
+	rate         float64
+	tokens       float64
+	last         time.Time
+	blockedUntil time.Time
+	// downloaders held while the host is blocked, added back by a single timer at the end of the block
+	held  map[string]bool
+	timer *time.Timer
+}
+
+func (l *hostLimiter) refill(now time.Time) {
+	l.tokens = math.Min(l.burst(), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+}
+
+func (l *hostLimiter) burst() float64 {
+	return math.Max(1, math.Ceil(l.rate))
+}
+
+/*
+rateLimiter limits the requests per host: only the downloads of a host answering 429 are throttled
+(the host is blocked for its Retry-After, and its rate is lowered), the other hosts and the fragmenters keep running.
+*/
+type rateLimiter struct {
+	hosts map[string]*hostLimiter
+	mu    sync.Mutex
+}
+
+var RateLimiter = &rateLimiter{
+	hosts: make(map[string]*hostLimiter),
+}
+
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.Host
+}
+
+func (r *rateLimiter) unsafeGet(host string) *hostLimiter {
+	l, ok := r.hosts[host]
+	if !ok {
+		l = &hostLimiter{rate: Env.RATE_LIMIT_PER_HOST, last: time.Now(), held: map[string]bool{}}
+		l.tokens = l.burst()
+		r.hosts[host] = l
+	}
+	return l
+}
+
+// reserve takes a token of the host and returns 0, or returns how long to wait for one.
+func (r *rateLimiter) reserve(host string) time.Duration {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := r.unsafeGet(host)
+	now := time.Now()
+	if l.blockedUntil.After(now) {
+		return l.blockedUntil.Sub(now)
+	}
+	l.refill(now)
+	if l.tokens >= 1 {
+		l.tokens--
+		return 0
+	}
+	return time.Duration((1 - l.tokens) / l.rate * float64(time.Second))
+}
+
+// wait blocks until a request can be sent to the host of rawURL, it returns ErrInterrupted if interruptionCheck returns true meanwhile.
+func (r *rateLimiter) wait(rawURL string, interruptionCheck func() bool) error {
+	host := urlHost(rawURL)
+	for {
+		d := r.reserve(host)
+		if d == 0 {
+			return nil
+		}
+		if interruptionCheck() {
+			return ErrInterrupted
+		}
+		if d > 200*time.Millisecond {
+			d = 200 * time.Millisecond
+		}
+		time.Sleep(d)
+	}
+}
+
+// IsBlocked returns true while the host of rawURL must not be requested (Retry-After of its last 429).
+func (r *rateLimiter) IsBlocked(rawURL string) bool {
+	host := urlHost(rawURL)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l, ok := r.hosts[host]
+	return ok && l.blockedUntil.After(time.Now())
+}
+
+// throttle blocks the host of rawURL for retryAfter (TIMEBREAK_AFTER_TOO_MANY_REQUESTS if 0) and lowers its rate.
+func (r *rateLimiter) throttle(rawURL string, retryAfter time.Duration) {
+	if retryAfter <= 0 {
+		retryAfter = TIMEBREAK_AFTER_TOO_MANY_REQUESTS
+	}
+	host := urlHost(rawURL)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := r.unsafeGet(host)
+	l.rate = math.Max(RATE_LIMIT_MIN, l.rate/RATE_LIMIT_DECREASE_FACTOR)
+	l.tokens = 0
+	if until := time.Now().Add(retryAfter); until.After(l.blockedUntil) {
+		l.blockedUntil = until
+		if l.timer != nil {
+			l.timer.Reset(retryAfter)
+		}
+	}
+	log.WithFields(log.Fields{
+		"host": host,
+		"for":  retryAfter.String(),
+		"rate": strconv.FormatFloat(l.rate, 'f', 2, 64) + "/s",
+	}).Warn("Too many requests, throttling host")
+}
+
+// success raises back the rate of the host of rawURL, up to RATE_LIMIT_PER_HOST.
+func (r *rateLimiter) success(rawURL string) {
+	host := urlHost(rawURL)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := r.unsafeGet(host)
+	l.rate = math.Min(Env.RATE_LIMIT_PER_HOST, l.rate+RATE_LIMIT_INCREASE)
+}
+
+// concurrency returns how many requests the host of rawURL currently accepts at once (its burst).
+func (r *rateLimiter) concurrency(rawURL string) int {
+	host := urlHost(rawURL)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return int(r.unsafeGet(host).burst())
+}
+
+// parseRetryAfter parses a Retry-After header (seconds or HTTP date), 0 if missing or invalid.
+func parseRetryAfter(h http.Header) time.Duration {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// blockedHost returns the host unblocked first among the candidates of a download (mirrors and official), "" if one of them is not blocked.
+func (r *rateLimiter) blockedHost(t pcommon.ArchiveType, rawURL string) string {
+	candidates := Mirrors.candidateURLs(t, rawURL)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	host := ""
+	until := time.Time{}
+	for _, candidate := range candidates {
+		l, ok := r.hosts[urlHost(candidate)]
+		if !ok || !l.blockedUntil.After(now) {
+			return ""
+		}
+		if host == "" || l.blockedUntil.Before(until) {
+			host, until = urlHost(candidate), l.blockedUntil
+		}
+	}
+	return host
+}
+
+// hold keeps a downloader failing with ErrHostThrottled out of the queue until its first candidate host is unblocked.
+func (r *rateLimiter) hold(runner *gorunner.Runner) {
+	date, _ := gorunner.GetArg[string](runner.Args, ARG_VALUE_DATE)
+	set, _ := gorunner.GetArg[*pcommon.SetJSON](runner.Args, ARG_VALUE_SET)
+	t, _ := gorunner.GetArg[pcommon.ArchiveType](runner.Args, ARG_VALUE_ARCHIVE_TYPE)
+	u, err := t.GetURL(date, set.Settings)
+	host := ""
+	if err == nil {
+		host = r.blockedHost(t, u)
+	}
+	if host == "" {
+		// unblocked meanwhile
+		Held.holdFor(runner, time.Second)
+		return
+	}
+
+	Held.hold(runner)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := r.unsafeGet(host)
+	l.held[runner.ID] = true
+	if l.timer == nil {
+		l.timer = time.AfterFunc(time.Until(l.blockedUntil), func() { r.releaseHost(host) })
+	}
+}
+
+// releaseHost adds back the downloaders held by a host once its block is over.
+func (r *rateLimiter) releaseHost(host string) {
+	r.mu.Lock()
+	l := r.unsafeGet(host)
+	if d := time.Until(l.blockedUntil); d > 0 {
+		// blocked again meanwhile
+		l.timer.Reset(d)
+		r.mu.Unlock()
+		return
+	}
+	ids := make([]string, 0, len(l.held))
+	for id := range l.held {
+		ids = append(ids, id)
+	}
+	l.held = map[string]bool{}
+	l.timer = nil
+	r.mu.Unlock()
+
+	for _, id := range ids {
+		Held.release(id)
+	}
+}
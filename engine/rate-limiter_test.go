@@ -0,0 +1,143 @@
+package engine
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fantasim/gorunner"
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+// resetHost forgets the rate limiter state of the host of rawURL once the test ends.
+func resetHost(t *testing.T, rawURL string) {
+	t.Cleanup(func() {
+		RateLimiter.mu.Lock()
+		defer RateLimiter.mu.Unlock()
+		if l, ok := RateLimiter.hosts[urlHost(rawURL)]; ok && l.timer != nil {
+			l.timer.Stop()
+		}
+		delete(RateLimiter.hosts, urlHost(rawURL))
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	for value, expected := range map[string]time.Duration{
+		"":        0,
+		"120":     2 * time.Minute,
+		"0":       0,
+		"-5":      0,
+		"soon":    0,
+		"1.5":     0,
+		"Mon, 02": 0,
+	} {
+		h := http.Header{}
+		if value != "" {
+			h.Set("Retry-After", value)
+		}
+		if d := parseRetryAfter(h); d != expected {
+			t.Errorf("Retry-After %q parsed as %s instead of %s", value, d, expected)
+		}
+	}
+
+	h := http.Header{}
+	h.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if d := parseRetryAfter(h); d < 59*time.Minute || d > time.Hour {
+		t.Fatalf("Retry-After HTTP date parsed as %s instead of about 1h", d)
+	}
+}
+
+func TestThrottleHost(t *testing.T) {
+	url := "http://throttled.test/data/archive.zip"
+	other := "http://other.test/data/archive.zip"
+	resetHost(t, url)
+	resetHost(t, other)
+
+	RateLimiter.throttle(url, time.Hour)
+	if !RateLimiter.IsBlocked(url) || RateLimiter.IsBlocked(other) {
+		t.Fatal("only the throttled host should be blocked")
+	}
+	RateLimiter.mu.Lock()
+	rate := RateLimiter.hosts[urlHost(url)].rate
+	RateLimiter.mu.Unlock()
+	if rate != Env.RATE_LIMIT_PER_HOST/RATE_LIMIT_DECREASE_FACTOR {
+		t.Fatalf("throttled host rate %.2f instead of halved", rate)
+	}
+	if RateLimiter.concurrency(url) >= RateLimiter.concurrency(other) {
+		t.Fatal("throttled host accepts as many requests at once")
+	}
+
+	// a shorter Retry-After does not shorten the block
+	RateLimiter.throttle(url, time.Second)
+	RateLimiter.mu.Lock()
+	until := RateLimiter.hosts[urlHost(url)].blockedUntil
+	rate = RateLimiter.hosts[urlHost(url)].rate
+	RateLimiter.mu.Unlock()
+	if time.Until(until) < 59*time.Minute {
+		t.Fatal("block shortened by a later Retry-After")
+	}
+
+	RateLimiter.success(url)
+	RateLimiter.mu.Lock()
+	raised := RateLimiter.hosts[urlHost(url)].rate
+	RateLimiter.mu.Unlock()
+	if raised <= rate {
+		t.Fatal("rate not raised back by a success")
+	}
+}
+
+func TestReleaseThrottledHost(t *testing.T) {
+	useTestEngine(t, true)
+	set := testSet(time.Minute, 3)
+	date := "2024-01-15"
+	url, err := pcommon.BINANCE_SPOT_TRADES.GetURL(date, set.Settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resetHost(t, url)
+
+	// a downloader that ran and failed with ErrHostThrottled
+	runs := &atomic.Int32{}
+	runner := gorunner.NewRunner("test-throttled")
+	runner.AddArgs(ARG_VALUE_DATE, date)
+	runner.AddArgs(ARG_VALUE_SET, &set)
+	runner.AddArgs(ARG_VALUE_ARCHIVE_TYPE, pcommon.BINANCE_SPOT_TRADES)
+	runner.AddProcess(func() error {
+		if runs.Add(1) == 1 {
+			return ErrHostThrottled
+		}
+		return nil
+	})
+	Engine.Add(runner)
+	waitRuns(t, runs, 1)
+	for !Engine.IsTaskDone(runner.ID) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	args := map[string]interface{}{ARG_VALUE_SET: &set}
+	t.Cleanup(func() { Held.drop(args) })
+
+	RateLimiter.throttle(url, 300*time.Millisecond)
+	RateLimiter.hold(runner)
+	if Held.count() != 1 {
+		t.Fatal("downloader of a throttled host not held")
+	}
+
+	// the timer fires while the host has been blocked again: it is armed again instead of releasing the downloader
+	RateLimiter.releaseHost(urlHost(url))
+	if Held.count() != 1 {
+		t.Fatal("downloader released while its host is still blocked")
+	}
+	RateLimiter.mu.Lock()
+	armed := RateLimiter.hosts[urlHost(url)].timer != nil
+	RateLimiter.mu.Unlock()
+	if !armed {
+		t.Fatal("host timer not armed again")
+	}
+
+	// released once the block is over, although it ran less than 6 hours ago
+	waitRuns(t, runs, 2)
+	if Held.count() != 0 {
+		t.Fatal("downloader still held after the block")
+	}
+}
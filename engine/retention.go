@@ -0,0 +1,258 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+const RETENTION_SWEEP_INTERVAL = 6 * time.Hour
+
+type RetentionAction string
+
+const (
+	// raw archives are kept forever (default)
+	RETENTION_KEEP RetentionAction = "keep"
+	// raw archives are deleted once their fragments are verified
+	RETENTION_DELETE RetentionAction = "delete"
+	// raw archives are moved to RETENTION_COLD_DIR once their fragments are verified
+	RETENTION_MOVE RetentionAction = "move"
+)
+
+type RetentionPolicy struct {
+	Action RetentionAction `json:"action"`
+	// the raw archives of the last KeepDays days are kept whatever the action
+	KeepDays int `json:"keep_days"`
+}
+
+type RetentionDecision struct {
+	SetID       string              `json:"set_id"`
+	ArchiveType pcommon.ArchiveType `json:"archive_type"`
+	Date        string              `json:"date"`
+	Path        string              `json:"path"`
+	Size        int64               `json:"size"`
+	Action      RetentionAction     `json:"action"`
+	Reason      string              `json:"reason"`
+	Destination string              `json:"destination,omitempty"`
+	Applied     bool                `json:"applied"`
+	Error       string              `json:"error,omitempty"`
+}
+
+/*
+parseRetentionPolicies parses a comma separated list of <archive_type>=<action>[:<keep_days>]
+ex: binance_spot_trades=delete,binance_book_depth=move:30
+*/
+func parseRetentionPolicies(s string) (map[pcommon.ArchiveType]RetentionPolicy, error) {
+	policies := map[pcommon.ArchiveType]RetentionPolicy{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid retention policy: %s", entry)
+		}
+		t := pcommon.ArchiveType(strings.TrimSpace(kv[0]))
+		if _, ok := pcommon.ArchivesIndex[t]; !ok {
+			return nil, fmt.Errorf("unknown archive type: %s", t)
+		}
+
+		parts := strings.SplitN(strings.TrimSpace(kv[1]), ":", 2)
+		policy := RetentionPolicy{Action: RetentionAction(parts[0])}
+		if policy.Action != RETENTION_KEEP && policy.Action != RETENTION_DELETE && policy.Action != RETENTION_MOVE {
+			return nil, fmt.Errorf("unknown retention action: %s", parts[0])
+		}
+		if len(parts) == 2 {
+			days, err := strconv.Atoi(parts[1])
+			if err != nil || days < 0 {
+				return nil, fmt.Errorf("invalid retention days: %s", parts[1])
+			}
+			policy.KeepDays = days
+		}
+		policies[t] = policy
+	}
+	return policies, nil
+}
+
+func getRetentionPolicy(t pcommon.ArchiveType) RetentionPolicy {
+	if p, ok := Env.RETENTION_POLICIES[t]; ok {
+		return p
+	}
+	return RetentionPolicy{Action: RETENTION_KEEP}
+}
+
+func getColdArchivePath(date string, set pcommon.SetSettings, t pcommon.ArchiveType) string {
+	return filepath.Join(Env.RETENTION_COLD_DIR, strings.ToUpper(set.IDString()), string(t), fmt.Sprintf("%s.zip", date))
+}
+
+// decideRetention returns what the policy says about the raw archive of a date, nil if there is no raw archive.
+func decideRetention(date string, set *pcommon.SetJSON, t pcommon.ArchiveType) *RetentionDecision {
+	archivePath := t.GetArchiveZipPath(date, set.Settings)
+	stat, err := Output.Stat(archivePath)
+	if err != nil {
+		return nil
+	}
+
+	policy := getRetentionPolicy(t)
+	d := &RetentionDecision{
+		SetID:       set.Settings.IDString(),
+		ArchiveType: t,
+		Date:        date,
+		Path:        archivePath,
+		Size:        stat.Size,
+		Action:      RETENTION_KEEP,
+	}
+
+	if policy.Action == RETENTION_KEEP {
+		d.Reason = "policy"
+		return d
+	}
+	if strings.Compare(date, pcommon.Format.BuildDateStr(policy.KeepDays)) >= 0 {
+		d.Reason = fmt.Sprintf("within the last %d days", policy.KeepDays)
+		return d
+	}
+	if policy.Action == RETENTION_MOVE && Env.RETENTION_COLD_DIR == "" {
+		d.Reason = "no cold directory"
+		return d
+	}
+
+	manifest, err := ReadFragmentManifest(date, set.Settings, t)
+	if err != nil {
+		d.Reason = "unreadable manifest: " + err.Error()
+		return d
+	}
+	if manifest == nil {
+		d.Reason = "not fragmented"
+		return d
+	}
+	if err := manifest.Verify(true); err != nil {
+		d.Reason = "fragments not verified: " + err.Error()
+		return d
+	}
+
+	d.Action = policy.Action
+	d.Reason = "fragments verified"
+	if policy.Action == RETENTION_MOVE {
+		d.Destination = getColdArchivePath(date, set.Settings, t)
+	}
+	return d
+}
+
+func (d *RetentionDecision) apply() {
+	var err error = nil
+	switch d.Action {
+	case RETENTION_DELETE:
+		err = Output.Delete(d.Path)
+	case RETENTION_MOVE:
+		err = moveToColdDir(d.Path, d.Destination)
+	default:
+		return
+	}
+	if err != nil {
+		d.Error = err.Error()
+		log.WithFields(log.Fields{
+			"path":  d.Path,
+			"error": d.Error,
+		}).Errorf("Failed to %s raw archive", d.Action)
+		return
+	}
+	d.Applied = true
+	fields := log.Fields{
+		"set":  d.SetID,
+		"date": d.Date,
+		"size": pcommon.Format.LargeBytesToShortString(d.Size),
+	}
+	if d.Action == RETENTION_MOVE {
+		fields["to"] = d.Destination
+	}
+	log.WithFields(fields).Infof("Retention: %s raw %s archive", d.Action, d.ArchiveType)
+}
+
+// moveToColdDir moves a stored raw archive to the (local) cold directory.
+func moveToColdDir(path string, destination string) error {
+	if isLocalStorage() {
+		return moveFile(path, destination)
+	}
+	body, err := Output.Get(path)
+	if err != nil {
+		return err
+	}
+	err = (&localStorage{}).Put(destination, body, -1)
+	body.Close()
+	if err != nil {
+		return err
+	}
+	return Output.Delete(path)
+}
+
+// applyRetention runs the retention policy on the raw archive of a date (called after fragmenting it).
+func applyRetention(date string, set *pcommon.SetJSON, t pcommon.ArchiveType, dryRun bool) *RetentionDecision {
+	d := decideRetention(date, set, t)
+	if d != nil && !dryRun {
+		d.apply()
+	}
+	return d
+}
+
+// RetentionSweep runs the retention policies on every raw archive of the active sets.
+// With dryRun, nothing is deleted or moved: the returned decisions are a report of what would be done.
+func (e *engine) RetentionSweep(dryRun bool) []RetentionDecision {
+	e.mu.RLock()
+	sets := make([]*pcommon.SetJSON, 0, len(e.activeSets))
+	for _, set := range e.activeSets {
+		sets = append(sets, set)
+	}
+	e.mu.RUnlock()
+
+	report := []RetentionDecision{}
+	for _, set := range sets {
+		for _, t := range pcommon.ARCHIVE_TYPE_LIST {
+			dir := filepath.Dir(t.GetArchiveZipPath("", set.Settings))
+			files, err := Output.List(dir)
+			if err != nil {
+				continue
+			}
+			for _, f := range files {
+				name := filepath.Base(f.Path)
+				date := strings.TrimSuffix(name, filepath.Ext(name))
+				if _, err := pcommon.Format.StrDateToDate(date); err != nil {
+					continue
+				}
+				if d := applyRetention(date, set, t, dryRun); d != nil {
+					report = append(report, *d)
+				}
+			}
+		}
+	}
+	return report
+}
+
+// RunRetentionLoop sweeps the raw archives every RETENTION_SWEEP_INTERVAL.
+func (e *engine) RunRetentionLoop() {
+	for !e.IsShuttingDown() {
+		time.Sleep(RETENTION_SWEEP_INTERVAL)
+		if len(Env.RETENTION_POLICIES) == 0 {
+			continue
+		}
+		report := e.RetentionSweep(Env.RETENTION_DRY_RUN)
+		var freed int64 = 0
+		count := 0
+		for _, d := range report {
+			if d.Action != RETENTION_KEEP {
+				freed += d.Size
+				count++
+			}
+		}
+		log.WithFields(log.Fields{
+			"archives": count,
+			"size":     pcommon.Format.LargeBytesToShortString(freed),
+			"dry_run":  Env.RETENTION_DRY_RUN,
+		}).Info("Retention sweep done")
+	}
+}
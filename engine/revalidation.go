@@ -0,0 +1,282 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+type RevalidationStatus string
+
+const (
+	REVALIDATION_UNCHANGED RevalidationStatus = "unchanged"
+	// the archive has been republished, it is downloaded and fragmented again
+	REVALIDATION_CHANGED RevalidationStatus = "changed"
+	// a previous republication is still being downloaded or fragmented
+	REVALIDATION_PENDING RevalidationStatus = "pending"
+	// nothing to compare the server with (no recorded headers nor published checksum)
+	REVALIDATION_UNKNOWN RevalidationStatus = "unknown"
+	REVALIDATION_ERROR   RevalidationStatus = "error"
+)
+
+type RevalidationResult struct {
+	SetID       string              `json:"set_id"`
+	ArchiveType pcommon.ArchiveType `json:"archive_type"`
+	Date        string              `json:"date"`
+	Status      RevalidationStatus  `json:"status"`
+	Reason      string              `json:"reason,omitempty"`
+}
+
+// RepublishedArchive marks an archive republished by the server: its fragments are rebuilt, and the parser must ingest them again.
+type RepublishedArchive struct {
+	SetID       string              `json:"set_id"`
+	ArchiveType pcommon.ArchiveType `json:"archive_type"`
+	Date        string              `json:"date"`
+	Assets      []pcommon.AssetType `json:"assets"`
+	Reason      string              `json:"reason"`
+	Previous    *RemoteArchive      `json:"previous,omitempty"`
+	Current     *RemoteArchive      `json:"current,omitempty"`
+	DetectedAt  int64               `json:"detected_at"`
+}
+
+func getRepublishedPath(date string, set pcommon.SetSettings, t pcommon.ArchiveType) string {
+	return filepath.Join(
+		pcommon.Env.ARCHIVES_DIR,
+		strings.ToUpper(set.IDString()),
+		"__republished",
+		string(t),
+		fmt.Sprintf("%s.json", date),
+	)
+}
+
+// ReadRepublishedArchive returns nil without error if the archive is not being fetched again.
+func ReadRepublishedArchive(date string, set pcommon.SetSettings, t pcommon.ArchiveType) (*RepublishedArchive, error) {
+	data, err := os.ReadFile(getRepublishedPath(date, set, t))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	r := RepublishedArchive{}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (r *RepublishedArchive) write(set pcommon.SetSettings) error {
+	fp := getRepublishedPath(r.Date, set, r.ArchiveType)
+	if err := pcommon.File.EnsureDir(filepath.Dir(fp)); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fp, data, 0644)
+}
+
+/*
+compareWithServer tells if the archive of a date has been republished since it was downloaded.
+The recorded preflight headers are compared first, a difference is confirmed with the published checksum
+when the source hash is known (a CDN can change the headers of the same content).
+Without recorded headers, only the published checksum is compared.
+It also returns the current headers of the archive, nil if unknown.
+*/
+func compareWithServer(date string, set *pcommon.SetJSON, t pcommon.ArchiveType) (RevalidationStatus, *RepublishedArchive, *RemoteArchive, error) {
+	officialURL, err := t.GetURL(date, set.Settings)
+	if err != nil {
+		return REVALIDATION_ERROR, nil, nil, err
+	}
+	previous, err := ReadRemoteArchive(date, set.Settings, t)
+	if err != nil {
+		return REVALIDATION_ERROR, nil, nil, err
+	}
+	manifest, err := ReadFragmentManifest(date, set.Settings, t)
+	if err != nil {
+		return REVALIDATION_ERROR, nil, nil, err
+	}
+	if previous == nil && manifest != nil {
+		previous = manifest.Remote
+	}
+
+	republished := &RepublishedArchive{
+		SetID:       set.Settings.IDString(),
+		ArchiveType: t,
+		Date:        date,
+		Assets:      t.GetTargetedAssets(),
+		Previous:    previous,
+	}
+
+	var current *RemoteArchive = nil
+	headersChanged := false
+	if previous != nil {
+		current, err = preflight(previous.URL, func() bool { return Engine.IsShuttingDown() })
+		if err != nil {
+			return REVALIDATION_ERROR, nil, nil, err
+		}
+		if current != nil && previous.sameContent(current) {
+			return REVALIDATION_UNCHANGED, nil, current, nil
+		}
+		if current != nil {
+			headersChanged = true
+			republished.Current = current
+			republished.Reason = "headers changed"
+		}
+	}
+
+	checksum := ""
+	if manifest != nil {
+		if checksum, err = fetchChecksum(officialURL); err != nil {
+			return REVALIDATION_ERROR, nil, nil, err
+		}
+	}
+	if checksum == "" {
+		// nothing to confirm the change with (not fragmented, or no checksum published)
+		if headersChanged {
+			return REVALIDATION_CHANGED, republished, current, nil
+		}
+		return REVALIDATION_UNKNOWN, nil, current, nil
+	}
+	if checksum == manifest.Source.SHA256 {
+		return REVALIDATION_UNCHANGED, nil, current, nil
+	}
+	republished.Reason = fmt.Sprintf("checksum changed (%s != %s)", checksum, manifest.Source.SHA256)
+	return REVALIDATION_CHANGED, republished, current, nil
+}
+
+/*
+refetchArchive removes the raw archive, the fragments and the manifest of a republished archive (and their offloaded copies),
+marks it and downloads it again: the downloader queues its fragmenter once the marker is found.
+*/
+func (e *engine) refetchArchive(set *pcommon.SetJSON, r *RepublishedArchive) error {
+	r.DetectedAt = time.Now().UnixMilli()
+	if err := r.write(set.Settings); err != nil {
+		return err
+	}
+	archivePath := r.ArchiveType.GetArchiveZipPath(r.Date, set.Settings)
+	paths := []string{archivePath}
+	for _, asset := range r.Assets {
+		paths = append(paths, set.Settings.BuildArchiveFilePath(asset, r.Date, "zip"))
+	}
+	// offloaded copies would still count as existing, and be rehydrated instead of downloaded
+	if err := Tiering.Drop(paths); err != nil {
+		return err
+	}
+	for _, fp := range paths {
+		Output.Delete(fp)
+		os.Remove(fp)
+	}
+	os.Remove(getManifestPath(r.Date, set.Settings, r.ArchiveType))
+	os.Remove(getRemoteArchivePath(r.Date, set.Settings, r.ArchiveType))
+
+	log.WithFields(log.Fields{
+		"set":    r.SetID,
+		"type":   r.ArchiveType,
+		"date":   r.Date,
+		"reason": r.Reason,
+	}).Warn("Archive republished, fetching it again")
+	// the downloader has likely run recently
+	Held.rerun(buildArchiveDownloader(r.Date, set, r.ArchiveType))
+	return nil
+}
+
+// resumeRepublished queues the runner a republished archive is waiting for (it may have been refused or interrupted).
+func (e *engine) resumeRepublished(date string, set *pcommon.SetJSON, t pcommon.ArchiveType) {
+	if fileExists(t.GetArchiveZipPath(date, set.Settings)) {
+		Held.rerun(buildArchiveFragmenter(date, set, t))
+	} else {
+		Held.rerun(buildArchiveDownloader(date, set, t))
+	}
+}
+
+/*
+Revalidate compares the archives of the last lookbackDays days of the active sets with the server,
+and fetches again the ones that have been republished. With dryRun, nothing is removed nor fetched.
+*/
+func (e *engine) Revalidate(lookbackDays int, dryRun bool) []RevalidationResult {
+	e.mu.RLock()
+	sets := make([]*pcommon.SetJSON, 0, len(e.activeSets))
+	for _, set := range e.activeSets {
+		sets = append(sets, set)
+	}
+	e.mu.RUnlock()
+
+	report := []RevalidationResult{}
+	for _, set := range sets {
+		for _, t := range pcommon.ARCHIVE_TYPE_LIST {
+			if !setUsesArchiveType(set, t) {
+				continue
+			}
+			for day := 1; day <= lookbackDays && !e.IsShuttingDown(); day++ {
+				date := pcommon.Format.BuildDateStr(day)
+				res := RevalidationResult{SetID: set.Settings.IDString(), ArchiveType: t, Date: date}
+
+				if pending, err := ReadRepublishedArchive(date, set.Settings, t); err != nil || pending != nil {
+					res.Status = REVALIDATION_PENDING
+					if err != nil {
+						res.Status, res.Reason = REVALIDATION_ERROR, err.Error()
+					} else if !dryRun {
+						e.resumeRepublished(date, set, t)
+					}
+					report = append(report, res)
+					continue
+				}
+
+				manifest, _ := ReadFragmentManifest(date, set.Settings, t)
+				remote, _ := ReadRemoteArchive(date, set.Settings, t)
+				if manifest == nil && remote == nil {
+					// never downloaded (or still being downloaded)
+					continue
+				}
+
+				status, republished, current, err := compareWithServer(date, set, t)
+				res.Status = status
+				if err != nil {
+					res.Reason = err.Error()
+				} else if status == REVALIDATION_UNCHANGED && current != nil && remote != nil && !dryRun {
+					// same content: the new headers are the reference from now on
+					writeRemoteArchive(getRemoteArchivePath(date, set.Settings, t), current)
+				} else if status == REVALIDATION_CHANGED {
+					res.Reason = republished.Reason
+					if !dryRun {
+						if err := e.refetchArchive(set, republished); err != nil {
+							res.Status, res.Reason = REVALIDATION_ERROR, err.Error()
+						}
+					}
+				}
+				report = append(report, res)
+			}
+		}
+	}
+	return report
+}
+
+// RunRevalidationLoop revalidates the last REVALIDATION_LOOKBACK_DAYS days every REVALIDATION_INTERVAL.
+func (e *engine) RunRevalidationLoop() {
+	for !e.IsShuttingDown() {
+		time.Sleep(Env.REVALIDATION_INTERVAL)
+		if Env.REVALIDATION_LOOKBACK_DAYS <= 0 {
+			continue
+		}
+		report := e.Revalidate(Env.REVALIDATION_LOOKBACK_DAYS, false)
+		counts := map[RevalidationStatus]int{}
+		for _, r := range report {
+			counts[r.Status]++
+		}
+		log.WithFields(log.Fields{
+			"checked":   len(report),
+			"changed":   counts[REVALIDATION_CHANGED],
+			"pending":   counts[REVALIDATION_PENDING],
+			"errors":    counts[REVALIDATION_ERROR],
+			"unchanged": counts[REVALIDATION_UNCHANGED],
+		}).Info("Revalidation done")
+	}
+}
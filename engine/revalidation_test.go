@@ -0,0 +1,58 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+func TestRefetchDropsOffloadedArchive(t *testing.T) {
+	bucket := &fakeBucket{objects: make(map[string][]byte)}
+	tier := newTestTiering(t, bucket)
+	useTestEngine(t, false)
+
+	set := testSet(time.Minute, 3)
+	date := "2024-01-15"
+	at := pcommon.BINANCE_SPOT_TRADES
+	paths := []string{at.GetArchiveZipPath(date, set.Settings)}
+	for _, asset := range at.GetTargetedAssets() {
+		paths = append(paths, set.Settings.BuildArchiveFilePath(asset, date, "zip"))
+	}
+	for _, path := range paths {
+		writeTestFile(t, path, "previous publication")
+		if err := tier.upload(set.Settings.IDString(), date, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	previousDays := Env.TIERING_LOCAL_DAYS
+	Env.TIERING_LOCAL_DAYS = 0
+	defer func() { Env.TIERING_LOCAL_DAYS = previousDays }()
+	if count, _ := tier.Evict(); count != len(paths) {
+		t.Fatalf("%d files evicted instead of %d", count, len(paths))
+	}
+
+	err := Engine.refetchArchive(&set, &RepublishedArchive{
+		SetID:       set.Settings.IDString(),
+		ArchiveType: at,
+		Date:        date,
+		Assets:      at.GetTargetedAssets(),
+		Reason:      "checksum changed",
+	})
+	defer Engine.StopSetRunners(&set)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		if fileExists(path) {
+			t.Fatalf("%s still exists after the refetch", path)
+		}
+	}
+	if len(bucket.objects) != 0 {
+		t.Fatalf("%d objects of the previous publication left in the bucket", len(bucket.objects))
+	}
+	if reason, err := downloadSkipReason(date, &set, at); reason != "" || err != nil {
+		t.Fatalf("republished archive not downloaded: %q (%v)", reason, err)
+	}
+}
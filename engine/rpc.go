@@ -0,0 +1,33 @@
+package engine
+
+import (
+	"fmt"
+	"time"
+)
+
+// how long a parser RPC request is waited for
+const RPC_REQUEST_TIMEOUT = 30 * time.Second
+
+type rpcResult[T any] struct {
+	value T
+	err   error
+}
+
+/*
+withRPCTimeout runs a parser RPC request and gives up after RPC_REQUEST_TIMEOUT: the RPC client has no timeout,
+so a parser that never answers would block the caller forever. The abandoned request keeps waiting in its goroutine.
+*/
+func withRPCTimeout[T any](method string, request func() (T, error)) (T, error) {
+	done := make(chan rpcResult[T], 1)
+	go func() {
+		value, err := request()
+		done <- rpcResult[T]{value: value, err: err}
+	}()
+	select {
+	case res := <-done:
+		return res.value, res.err
+	case <-time.After(RPC_REQUEST_TIMEOUT):
+		var zero T
+		return zero, fmt.Errorf("%s request timed out after %s", method, RPC_REQUEST_TIMEOUT)
+	}
+}
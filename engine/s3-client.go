@@ -0,0 +1,247 @@
+package engine
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const S3_UNSIGNED_PAYLOAD = "UNSIGNED-PAYLOAD"
+
+// s3Client is a minimal client of S3 compatible object stores (AWS, MinIO...) using path-style requests and SigV4 signatures.
+type s3Client struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+type S3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	ETag         string    `xml:"ETag"`
+	LastModified time.Time `xml:"LastModified"`
+	// x-amz-server-side-encryption header (aws:kms...), only set by PutObject, HeadObject and GetObject
+	Encryption string `xml:"-"`
+}
+
+type s3ListResult struct {
+	Contents              []S3Object `xml:"Contents"`
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+}
+
+func newS3Client(endpoint string, bucket string, region string, accessKey string, secretKey string) (*s3Client, error) {
+	u, err := url.Parse(strings.TrimRight(endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid s3 endpoint: %s", endpoint)
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	// an unresponsive bucket must not block a runner or the tiering loop: same connect and header timeouts as the downloads
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   Env.DOWNLOAD_CONNECT_TIMEOUT,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = Env.DOWNLOAD_CONNECT_TIMEOUT
+	transport.ResponseHeaderTimeout = Env.DOWNLOAD_HEADER_TIMEOUT
+	return &s3Client{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Transport: transport, Timeout: Env.S3_TIMEOUT},
+	}, nil
+}
+
+// s3Escape encodes s as required by SigV4 (RFC 3986 unreserved characters are kept, and '/' if keepSlash).
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func (c *s3Client) sign(req *http.Request, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	shortDate := now.Format("20060102")
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	keys := make([]string, 0, len(req.URL.Query()))
+	for k := range req.URL.Query() {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	query := make([]string, 0, len(keys))
+	for _, k := range keys {
+		query = append(query, s3Escape(k, false)+"="+s3Escape(req.URL.Query().Get(k), false))
+	}
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := fmt.Sprintf("host:%s\nx-amz-content-sha256:%s\nx-amz-date:%s\n", req.URL.Host, payloadHash, amzDate)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, true),
+		strings.Join(query, "&"),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", shortDate, c.region)
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(hashedRequest[:])}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), shortDate)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", c.accessKey, scope, signedHeaders, signature))
+}
+
+func (c *s3Client) request(method string, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path = strings.TrimRight(u.Path, "/") + "/" + c.bucket
+	if key != "" {
+		u.Path += "/" + strings.TrimLeft(key, "/")
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	c.sign(req, S3_UNSIGNED_PAYLOAD)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp, fmt.Errorf("s3 %s %s: %s %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// PutObject uploads size bytes from body and returns the stored object (ETag and encryption).
+func (c *s3Client) PutObject(key string, body io.Reader, size int64) (*S3Object, error) {
+	resp, err := c.request(http.MethodPut, key, nil, body, size)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	o := objectFromHeaders(key, resp)
+	o.Size = size
+	return o, nil
+}
+
+// GetObject returns the object body, to be closed by the caller.
+func (c *s3Client) GetObject(key string) (io.ReadCloser, *S3Object, error) {
+	resp, err := c.request(http.MethodGet, key, nil, nil, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Body, objectFromHeaders(key, resp), nil
+}
+
+// HeadObject returns nil without error if the object does not exist.
+func (c *s3Client) HeadObject(key string) (*S3Object, error) {
+	resp, err := c.request(http.MethodHead, key, nil, nil, 0)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return objectFromHeaders(key, resp), nil
+}
+
+func (c *s3Client) DeleteObject(key string) error {
+	resp, err := c.request(http.MethodDelete, key, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) ListObjects(prefix string) ([]S3Object, error) {
+	list := []S3Object{}
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.request(http.MethodGet, "", query, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		result := s3ListResult{}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range result.Contents {
+			o.ETag = strings.Trim(o.ETag, "\"")
+			list = append(list, o)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return list, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func objectFromHeaders(key string, resp *http.Response) *S3Object {
+	lastModified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return &S3Object{
+		Key:          key,
+		Size:         resp.ContentLength,
+		ETag:         strings.Trim(resp.Header.Get("ETag"), "\""),
+		LastModified: lastModified,
+		Encryption:   resp.Header.Get("x-amz-server-side-encryption"),
+	}
+}
@@ -0,0 +1,270 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// byteRange is an inclusive range of bytes [Start, End] of a file.
+type byteRange struct {
+	Start int64
+	End   int64
+}
+
+func (r byteRange) size() int64 {
+	return r.End - r.Start + 1
+}
+
+// segmentFilePath returns the file a segment is downloaded into: <output>.part.<start>-<end>
+func segmentFilePath(outputFilePath string, r byteRange) string {
+	return fmt.Sprintf("%s.part.%d-%d", outputFilePath, r.Start, r.End)
+}
+
+// findSegments returns the ranges of the segment files of outputFilePath left by a previous download, sorted by start.
+func findSegments(outputFilePath string) []byteRange {
+	paths, _ := filepath.Glob(outputFilePath + ".part.*")
+	ranges := []byteRange{}
+	for _, path := range paths {
+		bounds := strings.SplitN(strings.TrimPrefix(path, outputFilePath+".part."), "-", 2)
+		if len(bounds) != 2 {
+			continue
+		}
+		start, err1 := strconv.ParseInt(bounds[0], 10, 64)
+		end, err2 := strconv.ParseInt(bounds[1], 10, 64)
+		if err1 != nil || err2 != nil || end < start {
+			continue
+		}
+		ranges = append(ranges, byteRange{Start: start, End: end})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	return ranges
+}
+
+func removeSegments(outputFilePath string, ranges []byteRange) {
+	for _, r := range ranges {
+		os.Remove(segmentFilePath(outputFilePath, r))
+	}
+}
+
+// coversFile returns true if the sorted ranges are contiguous from the first to the last byte of a file of size bytes.
+func coversFile(ranges []byteRange, size int64) bool {
+	var next int64 = 0
+	for _, r := range ranges {
+		if r.Start != next {
+			return false
+		}
+		next = r.End + 1
+	}
+	return len(ranges) > 0 && next == size
+}
+
+// splitRanges splits a file of size bytes into count ranges of (almost) the same size.
+func splitRanges(size int64, count int) []byteRange {
+	ranges := make([]byteRange, 0, count)
+	segmentSize := size / int64(count)
+	var start int64 = 0
+	for i := 0; i < count; i++ {
+		end := start + segmentSize - 1
+		if i == count-1 {
+			end = size - 1
+		}
+		ranges = append(ranges, byteRange{Start: start, End: end})
+		start = end + 1
+	}
+	return ranges
+}
+
+/*
+planSegments returns the ranges url must be downloaded in, nil to download it at once.
+The segments of an interrupted download are reused if they still match the remote size.
+Otherwise the file is split in up to DOWNLOAD_SEGMENTS segments of at least DOWNLOAD_SEGMENT_MIN_SIZE,
+and no more than the requests the host currently accepts at once.
+*/
+func planSegments(url string, outputFilePath string, remote *RemoteArchive) []byteRange {
+	existing := findSegments(outputFilePath)
+	if remote == nil || !remote.AcceptRanges || remote.Size <= 0 {
+		removeSegments(outputFilePath, existing)
+		return nil
+	}
+	if coversFile(existing, remote.Size) {
+		return existing
+	}
+	removeSegments(outputFilePath, existing)
+
+	count := Env.DOWNLOAD_SEGMENTS
+	if n := remote.Size / Env.DOWNLOAD_SEGMENT_MIN_SIZE; n < int64(count) {
+		count = int(n)
+	}
+	if n := RateLimiter.concurrency(url); n < count {
+		count = n
+	}
+	if count <= 1 {
+		return nil
+	}
+	return splitRanges(remote.Size, count)
+}
+
+// downloadSegment downloads the missing bytes of a segment, appending them to its file.
+func downloadSegment(ctx context.Context, url string, path string, r byteRange, interruptionCheck func() bool, onProgress func(n int)) (writeFailed bool, err error) {
+	var done int64 = 0
+	if stat, err := os.Stat(path); err == nil {
+		done = stat.Size()
+	}
+	if done == r.size() {
+		return false, nil
+	}
+	if done > r.size() {
+		os.Remove(path)
+		done = 0
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := sendDownloadRequest(ctx, url, fmt.Sprintf("bytes=%d-%d", r.Start+done, r.End), interruptionCheck)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return false, failedResponseError(url, resp)
+	}
+	RateLimiter.success(url)
+	if resp.ContentLength != r.size()-done {
+		return false, ErrInvalidFileSize
+	}
+
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return true, err
+	}
+	defer out.Close()
+	if writeFailed, err := readBody(url, resp, out, cancel, interruptionCheck, onProgress); err != nil {
+		return writeFailed, err
+	}
+	return false, out.Close()
+}
+
+// assembleSegments concatenates the segment files into the first one and removes them, the first one is returned.
+func assembleSegments(outputFilePath string, ranges []byteRange) (string, error) {
+	firstPath := segmentFilePath(outputFilePath, ranges[0])
+	out, err := os.OpenFile(firstPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	for _, r := range ranges[1:] {
+		path := segmentFilePath(outputFilePath, r)
+		in, err := os.Open(path)
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(out, in)
+		in.Close()
+		if err != nil {
+			return "", err
+		}
+		os.Remove(path)
+	}
+	return firstPath, out.Close()
+}
+
+/*
+downloadSegmented downloads url in concurrent range requests, one per range, each into its own ".part.<start>-<end>" file,
+then concatenates them into outputFilePath (its checksum is verified by the caller).
+The first failing segment interrupts the others. Like a single download, the segments are kept on interruption to be resumed.
+*/
+func downloadSegmented(url string, outputFilePath string, ranges []byteRange, size int64, interruptionCheck func() bool, statusChange func(current int64, total int64), reserveSpace func(size int64) error) error {
+	var current int64 = 0
+	var largest int64 = 0
+	for _, r := range ranges {
+		if stat, err := os.Stat(segmentFilePath(outputFilePath, r)); err == nil {
+			current += stat.Size()
+		}
+		if r.size() > largest {
+			largest = r.size()
+		}
+	}
+	statusChange(current, size)
+
+	// the segments are concatenated one by one: a segment is on disk twice until it is removed
+	if err := reserveSpace(size - current + largest); err != nil {
+		return err
+	}
+
+	abort := func() {
+		log.WithFields(log.Fields{
+			"url": url,
+		}).Warn("Aborting download")
+		removeSegments(outputFilePath, ranges)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var failed atomic.Bool
+	segmentInterruptionCheck := func() bool {
+		return failed.Load() || interruptionCheck()
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	writeFailed := false
+	wg := sync.WaitGroup{}
+	for _, r := range ranges {
+		wg.Add(1)
+		go func(r byteRange) {
+			defer wg.Done()
+			wf, err := downloadSegment(ctx, url, segmentFilePath(outputFilePath, r), r, segmentInterruptionCheck, func(n int) {
+				mu.Lock()
+				defer mu.Unlock()
+				current += int64(n)
+				statusChange(current, size)
+			})
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			// the segments interrupted by the first failure return ErrInterrupted
+			if firstErr == nil {
+				firstErr = err
+				writeFailed = wf
+				failed.Store(true)
+				cancel()
+			}
+		}(r)
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		if writeFailed {
+			abort()
+		} else {
+			log.WithFields(log.Fields{
+				"url": url,
+			}).Info("Interrupting download (partial segments kept)")
+		}
+		return firstErr
+	}
+
+	path, err := assembleSegments(outputFilePath, ranges)
+	if err != nil {
+		abort()
+		return err
+	}
+	if stat, err := os.Stat(path); err != nil || stat.Size() != size {
+		os.Remove(path)
+		return ErrInvalidFileSize
+	}
+	return os.Rename(path, outputFilePath)
+}
@@ -0,0 +1,148 @@
+package engine
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// rangeServer serves content with Range support and records the Range header of each request.
+type rangeServer struct {
+	content []byte
+	ranges  []string
+	mu      sync.Mutex
+}
+
+func (s *rangeServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	s.mu.Unlock()
+	http.ServeContent(w, r, "archive.zip", time.Time{}, bytes.NewReader(s.content))
+}
+
+func newRangeServer(t *testing.T, size int) (*rangeServer, string) {
+	t.Helper()
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	s := &rangeServer{content: content}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	previous := downloadClient
+	downloadClient = server.Client()
+	t.Cleanup(func() { downloadClient = previous })
+	return s, server.URL + "/archive.zip"
+}
+
+func noInterruption() bool { return false }
+
+func noStatus(current int64, total int64) {}
+
+func noReservation(size int64) error { return nil }
+
+func TestPlanSegments(t *testing.T) {
+	previousSegments, previousMinSize := Env.DOWNLOAD_SEGMENTS, Env.DOWNLOAD_SEGMENT_MIN_SIZE
+	Env.DOWNLOAD_SEGMENTS, Env.DOWNLOAD_SEGMENT_MIN_SIZE = 4, 100
+	defer func() { Env.DOWNLOAD_SEGMENTS, Env.DOWNLOAD_SEGMENT_MIN_SIZE = previousSegments, previousMinSize }()
+
+	url := "http://segments.test/archive.zip"
+	out := filepath.Join(t.TempDir(), "archive.zip")
+
+	if r := planSegments(url, out, &RemoteArchive{Size: 1000}); r != nil {
+		t.Fatalf("host without range support split in %v", r)
+	}
+	if r := planSegments(url, out, &RemoteArchive{Size: 150, AcceptRanges: true}); r != nil {
+		t.Fatalf("archive smaller than 2 segments split in %v", r)
+	}
+	ranges := planSegments(url, out, &RemoteArchive{Size: 1000, AcceptRanges: true})
+	if len(ranges) != 4 || !coversFile(ranges, 1000) {
+		t.Fatalf("archive split in %v instead of 4 contiguous segments", ranges)
+	}
+
+	// the segments of an interrupted download are reused while the size matches
+	for _, r := range []byteRange{{0, 499}, {500, 999}} {
+		writeTestFile(t, segmentFilePath(out, r), "x")
+	}
+	if r := planSegments(url, out, &RemoteArchive{Size: 1000, AcceptRanges: true}); len(r) != 2 || r[1].Start != 500 {
+		t.Fatalf("existing segments not reused: %v", r)
+	}
+	// and removed once it changed
+	if r := planSegments(url, out, &RemoteArchive{Size: 1200, AcceptRanges: true}); len(r) != 4 || !coversFile(r, 1200) {
+		t.Fatalf("archive split in %v after a size change", r)
+	}
+	if len(findSegments(out)) != 0 {
+		t.Fatal("segments of the previous size kept")
+	}
+}
+
+func TestDownloadSegmented(t *testing.T) {
+	server, url := newRangeServer(t, 3000)
+	out := filepath.Join(t.TempDir(), "archive.zip")
+
+	ranges := splitRanges(3000, 3)
+	if err := downloadSegmented(url, out, ranges, 3000, noInterruption, noStatus, noReservation); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil || !bytes.Equal(data, server.content) {
+		t.Fatalf("reassembled file differs from the archive (%v)", err)
+	}
+	if len(findSegments(out)) != 0 {
+		t.Fatal("segment files kept after the assembly")
+	}
+}
+
+func TestDownloadSegmentedResumes(t *testing.T) {
+	server, url := newRangeServer(t, 3000)
+	out := filepath.Join(t.TempDir(), "archive.zip")
+
+	// an interrupted download: the first segment is complete, the second has 400 of its 1000 bytes
+	ranges := splitRanges(3000, 3)
+	writeTestFile(t, segmentFilePath(out, ranges[0]), string(server.content[:1000]))
+	writeTestFile(t, segmentFilePath(out, ranges[1]), string(server.content[1000:1400]))
+
+	if err := downloadSegmented(url, out, ranges, 3000, noInterruption, noStatus, noReservation); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil || !bytes.Equal(data, server.content) {
+		t.Fatalf("resumed file differs from the archive (%v)", err)
+	}
+	requested := strings.Join(server.ranges, ",")
+	if strings.Contains(requested, "bytes=0-") || !strings.Contains(requested, "bytes=1400-1999") || !strings.Contains(requested, "bytes=2000-2999") {
+		t.Fatalf("requested ranges %s instead of the missing bytes only", requested)
+	}
+}
+
+func TestDownloadSegmentedWriteFailure(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to fail the writes")
+	}
+	_, url := newRangeServer(t, 3000)
+	out := filepath.Join(t.TempDir(), "archive.zip")
+
+	ranges := splitRanges(3000, 3)
+	// the second segment can't be written (no space left on device)
+	if err := os.Symlink("/dev/full", segmentFilePath(out, ranges[1])); err != nil {
+		t.Fatal(err)
+	}
+	err := downloadSegmented(url, out, ranges, 3000, noInterruption, noStatus, noReservation)
+	if err == nil || errors.Is(err, ErrInterrupted) {
+		t.Fatalf("write failure returned %v", err)
+	}
+	// unlike an interruption, the segments are not kept to be resumed
+	if segments := findSegments(out); len(segments) != 0 {
+		t.Fatalf("segments %v kept after a write failure", segments)
+	}
+	if fileExists(out) {
+		t.Fatal("archive written after a write failure")
+	}
+}
@@ -0,0 +1,330 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+const SET_FILE_WATCH_INTERVAL = 5 * time.Second
+
+// interval between two polls of the set list and min timeframe of the parser, which does not push their changes
+const SET_CHANGE_POLL_INTERVAL = SET_POLLING_INTERVAL
+
+// SetProvider is the source of the sets the engine has to archive.
+type SetProvider interface {
+	// FetchSetList returns the complete list of sets currently active.
+	FetchSetList() ([]pcommon.SetJSON, error)
+	// FetchMinTimeframe returns the timeframe used to pick the asset consistency driving the downloads.
+	FetchMinTimeframe() (time.Duration, error)
+	// Watch calls onChange each time the set list (or their consistencies) changed. The returned function stops watching.
+	Watch(onChange func()) (stop func())
+	// Watching returns false while changes can't be detected (the engine then falls back to refreshing every minute).
+	Watching() bool
+}
+
+/* RPC provider (parser websocket) */
+
+type rpcSetProvider struct {
+	client   *pcommon.RPCClient
+	watching atomic.Bool
+
+	// the last answers of the parser, reused by the refreshes following a poll
+	sets         []pcommon.SetJSON
+	minTimeframe time.Duration
+	fetchedAt    time.Time
+	mu           sync.Mutex
+	// held while a request is in flight: identical requests share their RPC request id, so they must not overlap
+	requestMu sync.Mutex
+}
+
+func NewRPCSetProvider(client *pcommon.RPCClient) SetProvider {
+	return &rpcSetProvider{client: client}
+}
+
+// rpcProviderRequest sends one provider request at a time. A request abandoned on timeout keeps the others waiting until it returns.
+func rpcProviderRequest[T any](p *rpcSetProvider, method string, request func() (T, error)) (T, error) {
+	return withRPCTimeout(method, func() (T, error) {
+		p.requestMu.Lock()
+		defer p.requestMu.Unlock()
+		CountRPCRequests++
+		return request()
+	})
+}
+
+// fetch asks the parser for its min timeframe and set list, and keeps them for the refreshes of the next SET_CHANGE_POLL_INTERVAL.
+func (p *rpcSetProvider) fetch() ([]pcommon.SetJSON, time.Duration, error) {
+	status, err := rpcProviderRequest(p, "GetStatus", func() (*pcommon.GetStatusResponse, error) {
+		return pcommon.RPC.ParserRequests.FetchStatus(p.client)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	sets, err := rpcProviderRequest(p, "GetSetList", func() ([]pcommon.SetJSON, error) {
+		return pcommon.RPC.ParserRequests.FetchAvailableSetList(p.client)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	minTimeframe := time.Duration(status.MinTimeframe) * time.Millisecond
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sets, p.minTimeframe, p.fetchedAt = sets, minTimeframe, time.Now()
+	return sets, minTimeframe, nil
+}
+
+// cached returns the last answers of the parser if they are recent enough, or fetches them.
+func (p *rpcSetProvider) cached() ([]pcommon.SetJSON, time.Duration, error) {
+	p.mu.Lock()
+	if time.Since(p.fetchedAt) < SET_CHANGE_POLL_INTERVAL {
+		defer p.mu.Unlock()
+		return p.sets, p.minTimeframe, nil
+	}
+	p.mu.Unlock()
+	return p.fetch()
+}
+
+func (p *rpcSetProvider) FetchSetList() ([]pcommon.SetJSON, error) {
+	sets, _, err := p.cached()
+	return sets, err
+}
+
+func (p *rpcSetProvider) FetchMinTimeframe() (time.Duration, error) {
+	_, minTimeframe, err := p.cached()
+	return minTimeframe, err
+}
+
+func (p *rpcSetProvider) Watching() bool {
+	return p.watching.Load()
+}
+
+/*
+Watch polls the set list and the min timeframe of the parser every SET_CHANGE_POLL_INTERVAL (the parser has no change
+notification), and calls onChange when they differ from the previous poll. The refresh that follows reuses the polled
+answers, so a change costs no extra request. The provider is watching while the parser answers.
+*/
+func (p *rpcSetProvider) Watch(onChange func()) func() {
+	stop := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		last := ""
+		ticker := time.NewTicker(SET_CHANGE_POLL_INTERVAL)
+		defer ticker.Stop()
+		for {
+			current, err := p.fingerprint()
+			if err != nil {
+				if p.watching.Swap(false) {
+					log.WithFields(log.Fields{
+						"error": err.Error(),
+					}).Warn("Failed to poll parser set changes, refreshing every minute")
+				}
+			} else {
+				if !p.watching.Swap(true) {
+					log.Info("Polling parser set changes")
+				}
+				// the first poll only sets the reference, the engine refreshes on start anyway
+				if last != "" && current != last {
+					onChange()
+				}
+				last = current
+			}
+
+			select {
+			case <-stop:
+				p.watching.Store(false)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() { close(stop) })
+	}
+}
+
+// fingerprint polls the parser and returns the JSON of its set list and min timeframe, it changes with any set or consistency change.
+func (p *rpcSetProvider) fingerprint() (string, error) {
+	sets, minTimeframe, err := p.fetch()
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(sets)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%s", minTimeframe.Milliseconds(), data), nil
+}
+
+/* File provider (JSON config file) */
+
+type setFileContent struct {
+	MinTimeframe int64             `json:"min_timeframe"`
+	Sets         []pcommon.SetJSON `json:"sets"`
+}
+
+type fileSetProvider struct {
+	path string
+}
+
+// NewFileSetProvider reads the sets from a JSON file ({"min_timeframe": <ms>, "sets": [...]}), reloaded each time it is modified.
+func NewFileSetProvider(path string) SetProvider {
+	return &fileSetProvider{path: path}
+}
+
+func (p *fileSetProvider) read() (*setFileContent, error) {
+	data, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	content := setFileContent{}
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("invalid set file %s: %s", p.path, err.Error())
+	}
+	return &content, nil
+}
+
+func (p *fileSetProvider) FetchSetList() ([]pcommon.SetJSON, error) {
+	content, err := p.read()
+	if err != nil {
+		return nil, err
+	}
+	return content.Sets, nil
+}
+
+func (p *fileSetProvider) FetchMinTimeframe() (time.Duration, error) {
+	content, err := p.read()
+	if err != nil {
+		return 0, err
+	}
+	if content.MinTimeframe <= 0 {
+		return pcommon.Env.MIN_TIME_FRAME, nil
+	}
+	return time.Duration(content.MinTimeframe) * time.Millisecond, nil
+}
+
+func (p *fileSetProvider) Watching() bool {
+	return true
+}
+
+func (p *fileSetProvider) Watch(onChange func()) func() {
+	stop := make(chan struct{})
+	var once sync.Once
+
+	go func() {
+		lastModTime := time.Time{}
+		if stat, err := os.Stat(p.path); err == nil {
+			lastModTime = stat.ModTime()
+		}
+		ticker := time.NewTicker(SET_FILE_WATCH_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				stat, err := os.Stat(p.path)
+				if err != nil {
+					log.WithFields(log.Fields{
+						"error": err.Error(),
+					}).Warn("Error watching set file")
+					continue
+				}
+				if !stat.ModTime().Equal(lastModTime) {
+					lastModTime = stat.ModTime()
+					onChange()
+				}
+			}
+		}
+	}()
+
+	return func() {
+		once.Do(func() { close(stop) })
+	}
+}
+
+/* Memory provider (tests and embedding) */
+
+type MemorySetProvider struct {
+	sets         []pcommon.SetJSON
+	minTimeframe time.Duration
+	subscribers  map[int]func()
+	nextID       int
+	mu           sync.RWMutex
+}
+
+func NewMemorySetProvider(minTimeframe time.Duration, sets ...pcommon.SetJSON) *MemorySetProvider {
+	return &MemorySetProvider{
+		sets:         sets,
+		minTimeframe: minTimeframe,
+		subscribers:  make(map[int]func()),
+	}
+}
+
+func (p *MemorySetProvider) FetchSetList() ([]pcommon.SetJSON, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	list := make([]pcommon.SetJSON, len(p.sets))
+	copy(list, p.sets)
+	return list, nil
+}
+
+func (p *MemorySetProvider) FetchMinTimeframe() (time.Duration, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.minTimeframe, nil
+}
+
+func (p *MemorySetProvider) Watching() bool {
+	return true
+}
+
+func (p *MemorySetProvider) Watch(onChange func()) func() {
+	p.mu.Lock()
+	id := p.nextID
+	p.nextID++
+	p.subscribers[id] = onChange
+	p.mu.Unlock()
+
+	return func() {
+		p.mu.Lock()
+		delete(p.subscribers, id)
+		p.mu.Unlock()
+	}
+}
+
+// SetSets replaces the set list and notifies the subscribers.
+func (p *MemorySetProvider) SetSets(sets ...pcommon.SetJSON) {
+	p.mu.Lock()
+	p.sets = sets
+	p.mu.Unlock()
+	p.notify()
+}
+
+// SetMinTimeframe replaces the min timeframe and notifies the subscribers.
+func (p *MemorySetProvider) SetMinTimeframe(minTimeframe time.Duration) {
+	p.mu.Lock()
+	p.minTimeframe = minTimeframe
+	p.mu.Unlock()
+	p.notify()
+}
+
+func (p *MemorySetProvider) notify() {
+	p.mu.RLock()
+	subscribers := make([]func(), 0, len(p.subscribers))
+	for _, s := range p.subscribers {
+		subscribers = append(subscribers, s)
+	}
+	p.mu.RUnlock()
+	for _, s := range subscribers {
+		s()
+	}
+}
@@ -0,0 +1,77 @@
+package engine
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// how long the interrupted runners are given to return after the deadline (unzip, parse and zip can't be interrupted)
+const SHUTDOWN_QUIT_TIMEOUT = 30 * time.Second
+
+/*
+Shutdown stops the engine gracefully:
+ 1. no runner is started anymore
+ 2. running downloads are interrupted, their partial file is kept to resume the download on next start
+ 3. running fragmenters are given until deadline to finish, then interrupted (they roll back their output),
+    the ones still running SHUTDOWN_QUIT_TIMEOUT later are abandoned
+ 4. the state (pending parser notifications, runners held for a retry) is saved a last time and the RPC client is closed
+*/
+func (e *engine) Shutdown(deadline time.Duration) {
+	if e.shuttingDown.Swap(true) {
+		return
+	}
+	limit := time.Now().Add(deadline)
+	// no runner is started anymore, Quit is called before the pause ends
+	e.Pause(deadline + time.Minute)
+
+	log.WithFields(log.Fields{
+		"running":  e.CountRunning(),
+		"deadline": deadline.String(),
+	}).Info("Shutting down archiver...")
+
+	if e.stopWatch != nil {
+		e.stopWatch()
+	}
+
+	for _, r := range e.RunningRunners() {
+		if strings.HasPrefix(r.ID, "dl-") {
+			e.Cancel(r)
+		}
+	}
+
+	for e.CountRunning() > 0 && time.Now().Before(limit) {
+		time.Sleep(200 * time.Millisecond)
+	}
+	if count := e.CountRunning(); count > 0 {
+		log.WithFields(log.Fields{
+			"running": count,
+		}).Warn("Shutdown deadline reached, interrupting running fragmenters")
+	}
+	quit := make(chan struct{})
+	go func() {
+		e.Quit()
+		close(quit)
+	}()
+	select {
+	case <-quit:
+	case <-time.After(SHUTDOWN_QUIT_TIMEOUT):
+		log.WithFields(log.Fields{
+			"running": e.CountRunning(),
+		}).Error("Runners still running after being interrupted, exiting anyway")
+	}
+
+	if err := e.saveState(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Error saving archiver state")
+	}
+	if e.client != nil {
+		e.client.Stop()
+	}
+}
+
+func (e *engine) IsShuttingDown() bool {
+	return e.shuttingDown.Load()
+}
@@ -0,0 +1,126 @@
+package engine
+
+import (
+	"sync"
+	"time"
+)
+
+const STALL_CHECK_INTERVAL = time.Second
+
+type stallSample struct {
+	at        time.Time
+	bytes     int64
+	throttled time.Duration
+}
+
+/*
+stallDetector tells a download is stalled when, over the last window, it received less than minRate bytes
+per second, or when it received nothing for idleTimeout. The time spent waiting for the bandwidth cap is not counted.
+*/
+type stallDetector struct {
+	window      time.Duration
+	minRate     int64
+	idleTimeout time.Duration
+
+	startedAt    time.Time
+	lastProgress time.Time
+	samples      []stallSample
+	mu           sync.Mutex
+}
+
+func newStallDetector(window time.Duration, minRate int64, idleTimeout time.Duration) *stallDetector {
+	now := time.Now()
+	return &stallDetector{
+		window:       window,
+		minRate:      minRate,
+		idleTimeout:  idleTimeout,
+		startedAt:    now,
+		lastProgress: now,
+		samples:      []stallSample{},
+	}
+}
+
+func (d *stallDetector) unsafeTrim(now time.Time) {
+	i := 0
+	for i < len(d.samples) && now.Sub(d.samples[i].at) > d.window {
+		i++
+	}
+	d.samples = d.samples[i:]
+}
+
+// progress records n received bytes.
+func (d *stallDetector) progress(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	d.lastProgress = now
+	d.samples = append(d.samples, stallSample{at: now, bytes: int64(n)})
+	d.unsafeTrim(now)
+}
+
+// throttled records time spent waiting for the bandwidth cap.
+func (d *stallDetector) throttled(wait time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	// waiting is progress as well: the bytes have been received
+	d.lastProgress = now
+	d.samples = append(d.samples, stallSample{at: now, throttled: wait})
+	d.unsafeTrim(now)
+}
+
+func (d *stallDetector) stalled() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if d.idleTimeout > 0 && now.Sub(d.lastProgress) > d.idleTimeout {
+		return true
+	}
+	// the rate is only measured once a full window has elapsed
+	if d.minRate <= 0 || now.Sub(d.startedAt) < d.window {
+		return false
+	}
+	d.unsafeTrim(now)
+	var bytes int64 = 0
+	elapsed := d.window
+	for _, s := range d.samples {
+		bytes += s.bytes
+		elapsed -= s.throttled
+	}
+	if elapsed < d.window/2 {
+		// mostly throttled by the bandwidth cap
+		return false
+	}
+	return float64(bytes)/elapsed.Seconds() < float64(d.minRate)
+}
+
+/*
+watch calls onStall once if the download stalls, or onInterrupt once if interruptionCheck returns true,
+until the returned stop function is called.
+*/
+func (d *stallDetector) watch(interruptionCheck func() bool, onStall func(), onInterrupt func()) (stop func()) {
+	done := make(chan struct{})
+	once := sync.Once{}
+	go func() {
+		ticker := time.NewTicker(STALL_CHECK_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if interruptionCheck() {
+					onInterrupt()
+					return
+				}
+				if d.stalled() {
+					onStall()
+					return
+				}
+			}
+		}
+	}()
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
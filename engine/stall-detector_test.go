@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestStallDetector returns a detector started age ago, whose samples are set by the test.
+func newTestStallDetector(age time.Duration, samples ...stallSample) *stallDetector {
+	d := newStallDetector(10*time.Second, 1000, time.Minute)
+	d.startedAt = time.Now().Add(-age)
+	d.samples = samples
+	return d
+}
+
+func TestStallDetectorWindow(t *testing.T) {
+	now := time.Now()
+
+	// the rate is not measured before a full window
+	if d := newTestStallDetector(5 * time.Second); d.stalled() {
+		t.Fatal("stalled before a full window")
+	}
+	// 5000 bytes over 10s: under 1000 B/s
+	if d := newTestStallDetector(time.Minute, stallSample{at: now.Add(-time.Second), bytes: 5000}); !d.stalled() {
+		t.Fatal("download under the min rate not stalled")
+	}
+	if d := newTestStallDetector(time.Minute, stallSample{at: now.Add(-time.Second), bytes: 20000}); d.stalled() {
+		t.Fatal("download over the min rate stalled")
+	}
+	// received out of the window: not counted anymore
+	if d := newTestStallDetector(time.Minute, stallSample{at: now.Add(-20 * time.Second), bytes: 20000}); !d.stalled() {
+		t.Fatal("bytes received before the window counted")
+	}
+	// disabled
+	d := newTestStallDetector(time.Minute)
+	d.minRate = 0
+	if d.stalled() {
+		t.Fatal("stalled without min rate")
+	}
+}
+
+func TestStallDetectorThrottled(t *testing.T) {
+	now := time.Now()
+
+	// 7200 bytes in the 6s not spent waiting for the bandwidth cap: 1200 B/s (720 B/s over the whole window)
+	d := newTestStallDetector(time.Minute,
+		stallSample{at: now.Add(-3 * time.Second), bytes: 7200},
+		stallSample{at: now.Add(-time.Second), throttled: 4 * time.Second},
+	)
+	if d.stalled() {
+		t.Fatal("throttled time counted in the rate")
+	}
+	// mostly throttled: not measured
+	d = newTestStallDetector(time.Minute, stallSample{at: now.Add(-time.Second), throttled: 8 * time.Second})
+	if d.stalled() {
+		t.Fatal("download throttled most of the window stalled")
+	}
+
+	// waiting for the bandwidth cap is progress for the idle timeout
+	d = newTestStallDetector(time.Minute)
+	d.minRate = 0
+	d.lastProgress = now.Add(-2 * time.Minute)
+	d.throttled(time.Second)
+	if d.stalled() {
+		t.Fatal("throttled download idle")
+	}
+}
+
+func TestStallDetectorIdleTimeout(t *testing.T) {
+	d := newTestStallDetector(time.Minute)
+	d.minRate = 0
+	d.lastProgress = time.Now().Add(-2 * time.Minute)
+	if !d.stalled() {
+		t.Fatal("download receiving nothing for the idle timeout not stalled")
+	}
+	d.progress(1)
+	if d.stalled() {
+		t.Fatal("download stalled right after receiving bytes")
+	}
+	d.idleTimeout = 0
+	d.lastProgress = time.Now().Add(-time.Hour)
+	if d.stalled() {
+		t.Fatal("stalled with the idle timeout disabled")
+	}
+}
@@ -0,0 +1,83 @@
+package engine
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+// archiverState is what the engine persists while it runs and on shutdown, and reloads on start.
+type archiverState struct {
+	PendingNotifications []*FragmentManifest `json:"pending_notifications"`
+	// when the runners held for a retry may run again (unix ms), by runner ID
+	HeldRunners map[string]int64 `json:"held_runners,omitempty"`
+	// failures of the runners in backoff, by runner ID and error class
+	BackoffAttempts map[string]map[string]int `json:"backoff_attempts,omitempty"`
+}
+
+// serializes the writes of the state (notifiers, backoff, shutdown)
+var stateMu sync.Mutex
+
+func getStatePath() string {
+	return filepath.Join(pcommon.Env.ARCHIVES_DIR, "__state.json")
+}
+
+func (e *engine) saveState() error {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	state := archiverState{
+		PendingNotifications: e.pendingNotifications.all(true),
+		HeldRunners:          Held.retryTimes(),
+		BackoffAttempts:      Backoff.attempts(),
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// a crash while writing must not leave a truncated state
+	tmp := getStatePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, getStatePath())
+}
+
+/*
+persistState saves the state as soon as it changes (pending notification added or accepted, runner held for a retry),
+so a crash does not lose it. Only the process that locked ARCHIVES_DIR (see Start) writes it.
+*/
+func (e *engine) persistState() {
+	if e == nil || !e.started.Load() {
+		return
+	}
+	if err := e.saveState(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Warn("Error saving archiver state")
+	}
+}
+
+// loadState reloads the persisted state, the file is kept until the next saveState overwrites it.
+func (e *engine) loadState() error {
+	data, err := os.ReadFile(getStatePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	state := archiverState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	for _, m := range state.PendingNotifications {
+		e.pendingNotifications.add(m)
+	}
+	Held.restore(state.HeldRunners)
+	Backoff.restore(state.BackoffAttempts)
+	return nil
+}
@@ -0,0 +1,66 @@
+package engine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/fantasim/gorunner"
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+func TestStatePersistedWhileRunning(t *testing.T) {
+	pcommon.Env.ARCHIVES_DIR = t.TempDir()
+	useTestEngine(t, false)
+	Engine.started.Store(true)
+
+	set := testSet(time.Minute, 3)
+	date := "2024-01-15"
+	args := map[string]interface{}{ARG_VALUE_SET: &set}
+	t.Cleanup(func() { Held.drop(args) })
+
+	// a notification being sent is persisted before the parser answers
+	manifest := &FragmentManifest{SetID: set.Settings.IDString(), ArchiveType: pcommon.BINANCE_SPOT_TRADES, Date: date}
+	if !Engine.pendingNotifications.send(manifest) {
+		t.Fatal("manifest already being sent")
+	}
+	Engine.persistState()
+
+	runner := buildArchiveDownloader(date, &set, pcommon.BINANCE_SPOT_TRADES)
+	Backoff.onError(runner, RETRY_CLASS_SERVER, ErrFailedDownload)
+	t.Cleanup(func() { Backoff.forget(runner) })
+
+	// the next process reloads what the previous one left, without shutting down
+	Held.drop(args)
+	Backoff.forget(runner)
+	Engine.pendingNotifications = pendingNotifications{}
+	if err := Engine.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if pending := Engine.pendingNotifications.all(true); len(pending) != 1 || pending[0].Date != date {
+		t.Fatalf("pending notifications %+v", pending)
+	}
+	if attempts := Backoff.attempts()[runner.ID][RETRY_CLASS_SERVER]; attempts != 1 {
+		t.Fatalf("%d server attempts restored instead of 1", attempts)
+	}
+
+	// the refresh queues the runner again: it is held until its retry time
+	Engine.DownloadArchive(date, &set, pcommon.BINANCE_SPOT_TRADES)
+	if Held.count() != 1 || Engine.CountQueued() != 0 {
+		t.Fatalf("%d runners held and %d queued instead of 1 and 0", Held.count(), Engine.CountQueued())
+	}
+}
+
+func TestRestoredRunnerAddedBack(t *testing.T) {
+	useTestEngine(t, false)
+
+	runner := gorunner.NewRunner("test-restored")
+	Held.restore(map[string]int64{runner.ID: time.Now().Add(50 * time.Millisecond).UnixMilli()})
+	if !Held.holdRestored(runner) {
+		t.Fatal("runner with a future retry time should be held")
+	}
+	// never ran in this process: it must not wait to be done to be added back
+	waitQueued(t, 1)
+	if Held.holdRestored(gorunner.NewRunner("test-restored")) {
+		t.Fatal("restored retry time applied twice")
+	}
+}
@@ -0,0 +1,265 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+const (
+	STORAGE_LOCAL = "local"
+	STORAGE_S3    = "s3"
+)
+
+type StorageObject struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+/*
+Storage is where raw archives and fragments are stored. Paths are the ones built by pcommon
+(GetArchiveZipPath, BuildArchiveFilePath), under ARCHIVES_DIR; the local disk is only used as scratch space.
+*/
+type Storage interface {
+	Put(path string, r io.Reader, size int64) error
+	// Get returns the stored file content, to be closed by the caller.
+	Get(path string) (io.ReadCloser, error)
+	// Stat returns an error satisfying os.IsNotExist if the file is not stored.
+	Stat(path string) (*StorageObject, error)
+	// List returns the files stored under the dir path.
+	List(dir string) ([]StorageObject, error)
+	Delete(path string) error
+}
+
+// Output is the storage of raw archives and fragments.
+var Output Storage = &localStorage{}
+
+func initStorage() error {
+	switch Env.STORAGE_BACKEND {
+	case STORAGE_LOCAL:
+		Output = &localStorage{}
+	case STORAGE_S3:
+		client, err := newS3Client(Env.S3_ENDPOINT, Env.S3_BUCKET, Env.S3_REGION, Env.S3_ACCESS_KEY, Env.S3_SECRET_KEY)
+		if err != nil {
+			return err
+		}
+		Output = &s3Storage{client: client, prefix: strings.Trim(Env.S3_PREFIX, "/")}
+	default:
+		return fmt.Errorf("unknown storage backend: %s", Env.STORAGE_BACKEND)
+	}
+	return nil
+}
+
+func isLocalStorage() bool {
+	_, ok := Output.(*localStorage)
+	return ok
+}
+
+// storeLocalFile moves a file built on local disk at path to the output storage.
+func storeLocalFile(path string) error {
+	if isLocalStorage() {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = Output.Put(path, f, stat.Size())
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// fetchLocalFile makes a stored file available on local disk at path. The returned function removes the local copy if it was fetched.
+// A file offloaded to the bucket is rehydrated instead, and stays on local disk until it is evicted again.
+func fetchLocalFile(path string) (func(), error) {
+	if _, err := os.Stat(path); err == nil || isLocalStorage() {
+		if err != nil && Tiering.IsRemote(path) {
+			// offloaded to the bucket: rehydrated on access
+			return func() {}, Tiering.rehydrateFile(path)
+		}
+		return func() {}, err
+	}
+	body, err := Output.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	if err := pcommon.File.EnsureDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	tmp := path + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return nil, err
+	}
+	_, err = io.Copy(f, body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	return func() { os.Remove(path) }, nil
+}
+
+/* Local disk */
+
+type localStorage struct{}
+
+func (s *localStorage) Put(path string, r io.Reader, size int64) error {
+	if err := pcommon.File.EnsureDir(filepath.Dir(path)); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (s *localStorage) Get(path string) (io.ReadCloser, error) {
+	return os.Open(path)
+}
+
+func (s *localStorage) Stat(path string) (*StorageObject, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &StorageObject{Path: path, Size: stat.Size(), ModTime: stat.ModTime()}, nil
+}
+
+func (s *localStorage) List(dir string) ([]StorageObject, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	list := []StorageObject{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		list = append(list, StorageObject{Path: filepath.Join(dir, entry.Name()), Size: info.Size(), ModTime: info.ModTime()})
+	}
+	return list, nil
+}
+
+func (s *localStorage) Delete(path string) error {
+	return os.Remove(path)
+}
+
+/* S3 compatible bucket */
+
+type s3Storage struct {
+	client *s3Client
+	prefix string
+}
+
+func (s *s3Storage) key(path string) (string, error) {
+	rel, err := filepath.Rel(pcommon.Env.ARCHIVES_DIR, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fmt.Errorf("%s is not in the archives directory", path)
+	}
+	key := filepath.ToSlash(rel)
+	if s.prefix != "" {
+		key = s.prefix + "/" + key
+	}
+	return key, nil
+}
+
+func (s *s3Storage) path(key string) string {
+	return filepath.Join(pcommon.Env.ARCHIVES_DIR, filepath.FromSlash(strings.TrimPrefix(strings.TrimPrefix(key, s.prefix), "/")))
+}
+
+func (s *s3Storage) Put(path string, r io.Reader, size int64) error {
+	key, err := s.key(path)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutObject(key, r, size)
+	return err
+}
+
+func (s *s3Storage) Get(path string) (io.ReadCloser, error) {
+	key, err := s.key(path)
+	if err != nil {
+		return nil, err
+	}
+	body, _, err := s.client.GetObject(key)
+	return body, err
+}
+
+func (s *s3Storage) Stat(path string) (*StorageObject, error) {
+	key, err := s.key(path)
+	if err != nil {
+		return nil, err
+	}
+	o, err := s.client.HeadObject(key)
+	if err != nil {
+		return nil, err
+	}
+	if o == nil {
+		return nil, &os.PathError{Op: "stat", Path: path, Err: os.ErrNotExist}
+	}
+	return &StorageObject{Path: path, Size: o.Size, ModTime: o.LastModified}, nil
+}
+
+func (s *s3Storage) List(dir string) ([]StorageObject, error) {
+	prefix, err := s.key(dir)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := s.client.ListObjects(strings.TrimSuffix(prefix, "/") + "/")
+	if err != nil {
+		return nil, err
+	}
+	list := []StorageObject{}
+	for _, o := range objects {
+		// only the files directly under dir, as on local disk
+		if strings.Contains(strings.TrimPrefix(o.Key, strings.TrimSuffix(prefix, "/")+"/"), "/") {
+			continue
+		}
+		list = append(list, StorageObject{Path: s.path(o.Key), Size: o.Size, ModTime: o.LastModified})
+	}
+	return list, nil
+}
+
+func (s *s3Storage) Delete(path string) error {
+	key, err := s.key(path)
+	if err != nil {
+		return err
+	}
+	return s.client.DeleteObject(key)
+}
@@ -0,0 +1,412 @@
+package engine
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+const TIERING_SWEEP_INTERVAL = 6 * time.Hour
+
+// TieringEntry tells where a file of ARCHIVES_DIR lives: on local disk, in the bucket, or both.
+type TieringEntry struct {
+	SetID      string `json:"set_id"`
+	Date       string `json:"date"`
+	Path       string `json:"path"`
+	Key        string `json:"key"`
+	Size       int64  `json:"size"`
+	MD5        string `json:"md5"`
+	UploadedAt int64  `json:"uploaded_at"`
+	Local      bool   `json:"local"`
+	Remote     bool   `json:"remote"`
+}
+
+// tiering offloads fragments and raw archives to an S3 compatible bucket, and keeps a local index (ARCHIVES_DIR/__tiering.json) of what lives where.
+type tiering struct {
+	bucket      *s3Storage
+	entries     map[string]*TieringEntry
+	mu          sync.RWMutex
+	rehydrating sync.Mutex
+}
+
+// Tiering is nil when no bucket is configured.
+var Tiering *tiering = nil
+
+// tiering only applies to local storage: with the s3 backend, files are directly stored in the bucket.
+func initTiering() error {
+	if Env.S3_ENDPOINT == "" || Env.STORAGE_BACKEND != STORAGE_LOCAL {
+		return nil
+	}
+	client, err := newS3Client(Env.S3_ENDPOINT, Env.S3_BUCKET, Env.S3_REGION, Env.S3_ACCESS_KEY, Env.S3_SECRET_KEY)
+	if err != nil {
+		return err
+	}
+	t := &tiering{
+		bucket:  &s3Storage{client: client, prefix: strings.Trim(Env.S3_PREFIX, "/")},
+		entries: make(map[string]*TieringEntry),
+	}
+	if err := t.load(); err != nil {
+		return err
+	}
+	Tiering = t
+	return nil
+}
+
+func getTieringIndexPath() string {
+	return filepath.Join(pcommon.Env.ARCHIVES_DIR, "__tiering.json")
+}
+
+func (t *tiering) load() error {
+	data, err := os.ReadFile(getTieringIndexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	list := []*TieringEntry{}
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	for _, e := range list {
+		t.entries[e.Path] = e
+	}
+	return nil
+}
+
+func (t *tiering) unsafeSave() error {
+	list := make([]*TieringEntry, 0, len(t.entries))
+	for _, e := range t.entries {
+		list = append(list, e)
+	}
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := getTieringIndexPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, getTieringIndexPath())
+}
+
+func md5File(fp string) (string, int64, error) {
+	f, err := os.Open(fp)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := md5.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+/*
+isMD5ETag returns true if the ETag of an object is the md5 of its content: 32 hex characters, without the -<parts> suffix
+of a multipart upload, and not encrypted with SSE-KMS (its ETags look like md5s but are not).
+*/
+func isMD5ETag(o *S3Object) bool {
+	if len(o.ETag) != 32 || strings.HasPrefix(o.Encryption, "aws:kms") {
+		return false
+	}
+	_, err := hex.DecodeString(o.ETag)
+	return err == nil
+}
+
+// IsRemote returns true if the file at path has been offloaded and its local copy deleted.
+func (t *tiering) IsRemote(path string) bool {
+	if t == nil {
+		return false
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	e, ok := t.entries[path]
+	return ok && e.Remote && !e.Local
+}
+
+/*
+upload puts a local file in the bucket and checks the stored object: a single part ETag must be the md5 of the file.
+Multipart and SSE-KMS ETags are not md5s, only the size of the object is checked then (HEAD request).
+The md5 is kept to detect local changes and check rehydrations.
+*/
+func (t *tiering) upload(setID string, date string, path string) error {
+	sum, size, err := md5File(path)
+	if err != nil {
+		return err
+	}
+
+	t.mu.RLock()
+	e, ok := t.entries[path]
+	t.mu.RUnlock()
+	if ok && e.Remote && e.MD5 == sum {
+		return nil
+	}
+
+	key, err := t.bucket.key(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	stored, err := t.bucket.client.PutObject(key, f, size)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	if isMD5ETag(stored) {
+		if !strings.EqualFold(stored.ETag, sum) {
+			return fmt.Errorf("uploaded %s md5 mismatch", key)
+		}
+	} else {
+		o, err := t.bucket.client.HeadObject(key)
+		if err != nil {
+			return err
+		}
+		if o == nil || o.Size != size {
+			return fmt.Errorf("uploaded %s size mismatch", key)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[path] = &TieringEntry{
+		SetID:      setID,
+		Date:       date,
+		Path:       path,
+		Key:        key,
+		Size:       size,
+		MD5:        sum,
+		UploadedAt: time.Now().UnixMilli(),
+		Local:      true,
+		Remote:     true,
+	}
+	return t.unsafeSave()
+}
+
+// OffloadFragments uploads the fragments of a manifest and their raw archive (if still on disk).
+func (t *tiering) OffloadFragments(m *FragmentManifest) error {
+	if t == nil {
+		return nil
+	}
+	paths := m.Paths()
+	if _, err := os.Stat(m.Source.Path); err == nil {
+		paths = append(paths, m.Source.Path)
+	}
+	for _, p := range paths {
+		if err := t.upload(m.SetID, m.Date, p); err != nil {
+			return err
+		}
+	}
+	log.WithFields(log.Fields{
+		"set":   m.SetID,
+		"date":  m.Date,
+		"files": len(paths),
+	}).Infof("Offloaded %s fragments to bucket", m.ArchiveType)
+	return nil
+}
+
+// Evict deletes the local copies of the offloaded files older than TIERING_LOCAL_DAYS (if they still match the uploaded ones).
+func (t *tiering) Evict() (int, int64) {
+	if t == nil || Env.TIERING_LOCAL_DAYS < 0 {
+		return 0, 0
+	}
+	minDate := pcommon.Format.BuildDateStr(Env.TIERING_LOCAL_DAYS)
+
+	t.mu.RLock()
+	candidates := []TieringEntry{}
+	for _, e := range t.entries {
+		if e.Local && e.Remote && strings.Compare(e.Date, minDate) < 0 {
+			candidates = append(candidates, *e)
+		}
+	}
+	t.mu.RUnlock()
+
+	count := 0
+	var size int64 = 0
+	for _, c := range candidates {
+		sum, _, err := md5File(c.Path)
+		if err != nil && !os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			if sum != c.MD5 {
+				// modified since its upload, it will be uploaded again
+				continue
+			}
+			if err := os.Remove(c.Path); err != nil {
+				continue
+			}
+			count++
+			size += c.Size
+		}
+		t.mu.Lock()
+		if e, ok := t.entries[c.Path]; ok {
+			e.Local = false
+		}
+		t.mu.Unlock()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.unsafeSave(); err != nil {
+		log.WithFields(log.Fields{
+			"error": err.Error(),
+		}).Error("Error saving tiering index")
+	}
+	return count, size
+}
+
+/*
+Drop deletes the bucket objects of the offloaded paths and forgets them, so that a republished archive is not
+rehydrated from its previous publication, and is offloaded again once downloaded and fragmented.
+*/
+func (t *tiering) Drop(paths []string) error {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dropped := 0
+	for _, path := range paths {
+		e, ok := t.entries[path]
+		if !ok {
+			continue
+		}
+		if e.Remote {
+			if err := t.bucket.client.DeleteObject(e.Key); err != nil {
+				return err
+			}
+		}
+		delete(t.entries, path)
+		dropped++
+	}
+	if dropped == 0 {
+		return nil
+	}
+	return t.unsafeSave()
+}
+
+// Rehydrate downloads back to local disk all the offloaded files of a set for a date.
+func (t *tiering) Rehydrate(setID string, date string) ([]string, error) {
+	if t == nil {
+		return nil, fmt.Errorf("tiering is not configured")
+	}
+
+	t.mu.RLock()
+	list := []string{}
+	for _, e := range t.entries {
+		if e.SetID == setID && e.Date == date && !e.Local {
+			list = append(list, e.Path)
+		}
+	}
+	t.mu.RUnlock()
+
+	restored := []string{}
+	for _, path := range list {
+		if err := t.rehydrateFile(path); err != nil {
+			return restored, err
+		}
+		restored = append(restored, path)
+	}
+	return restored, nil
+}
+
+// rehydrateFile downloads back an offloaded file, it stays on local disk until it is evicted again.
+func (t *tiering) rehydrateFile(path string) error {
+	// two runners may need the same file
+	t.rehydrating.Lock()
+	defer t.rehydrating.Unlock()
+
+	t.mu.RLock()
+	e, ok := t.entries[path]
+	var entry TieringEntry
+	if ok {
+		entry = *e
+	}
+	t.mu.RUnlock()
+	if !ok || !entry.Remote {
+		return fmt.Errorf("%s is not offloaded", path)
+	}
+	if entry.Local {
+		return nil
+	}
+
+	if err := t.download(entry); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.entries[path].Local = true
+	return t.unsafeSave()
+}
+
+func (t *tiering) download(e TieringEntry) error {
+	body, _, err := t.bucket.client.GetObject(e.Key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if err := pcommon.File.EnsureDir(filepath.Dir(e.Path)); err != nil {
+		return err
+	}
+	tmp := e.Path + ".part"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	h := md5.New()
+	_, err = io.Copy(io.MultiWriter(f, h), body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != e.MD5 {
+		os.Remove(tmp)
+		return fmt.Errorf("rehydrated %s md5 mismatch (%s != %s)", e.Key, sum, e.MD5)
+	}
+	return os.Rename(tmp, e.Path)
+}
+
+// RunLoop evicts the local copies of offloaded files every TIERING_SWEEP_INTERVAL.
+func (t *tiering) RunLoop() {
+	if t == nil {
+		return
+	}
+	for !Engine.IsShuttingDown() {
+		time.Sleep(TIERING_SWEEP_INTERVAL)
+		count, size := t.Evict()
+		if count > 0 {
+			log.WithFields(log.Fields{
+				"files": count,
+				"size":  pcommon.Format.LargeBytesToShortString(size),
+			}).Info("Evicted local copies of offloaded files")
+		}
+	}
+}
+
+// fileExists returns true if the file is in the output storage or has been offloaded to the bucket.
+func fileExists(path string) bool {
+	if _, err := Output.Stat(path); err == nil {
+		return true
+	}
+	return Tiering.IsRemote(path)
+}
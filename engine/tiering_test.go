@@ -0,0 +1,217 @@
+package engine
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	pcommon "github.com/pendulea/pendule-common"
+)
+
+// fakeBucket is an in-memory S3 bucket answering PUT, GET, HEAD and DELETE with multipart-style ETags (not an md5) by default.
+type fakeBucket struct {
+	objects map[string][]byte
+	// bytes dropped from each stored object, to simulate a truncated upload
+	truncate int
+	// single part uploads: the ETag is the md5 of the stored object
+	md5ETags bool
+	// x-amz-server-side-encryption of the objects, aws:kms ETags look like md5s without being one
+	encryption string
+	mu         sync.Mutex
+}
+
+func (b *fakeBucket) etag(data []byte) string {
+	if b.encryption == "aws:kms" {
+		return "\"0123456789abcdef0123456789abcdef\""
+	}
+	if b.md5ETags {
+		sum := md5.Sum(data)
+		return "\"" + hex.EncodeToString(sum[:]) + "\""
+	}
+	return "\"d41d8cd98f00b204e9800998ecf8427e-2\""
+}
+
+func (b *fakeBucket) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		b.objects[r.URL.Path] = data[:len(data)-b.truncate]
+		w.Header().Set("ETag", b.etag(b.objects[r.URL.Path]))
+		if b.encryption != "" {
+			w.Header().Set("x-amz-server-side-encryption", b.encryption)
+		}
+	case http.MethodGet, http.MethodHead:
+		data, ok := b.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", b.etag(data))
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case http.MethodDelete:
+		delete(b.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestTiering(t *testing.T, bucket *fakeBucket) *tiering {
+	t.Helper()
+	server := httptest.NewServer(bucket)
+	t.Cleanup(server.Close)
+
+	pcommon.Env.ARCHIVES_DIR = t.TempDir()
+	client, err := newS3Client(server.URL, "archives", "", "key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tier := &tiering{
+		bucket:  &s3Storage{client: client, prefix: "pendule"},
+		entries: make(map[string]*TieringEntry),
+	}
+	previous := Tiering
+	Tiering = tier
+	t.Cleanup(func() { Tiering = previous })
+	return tier
+}
+
+func writeTestFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTieringRehydratesOnAccess(t *testing.T) {
+	bucket := &fakeBucket{objects: make(map[string][]byte)}
+	tier := newTestTiering(t, bucket)
+
+	path := filepath.Join(pcommon.Env.ARCHIVES_DIR, "BTCUSDT", "trades", "2024-01-15.csv")
+	writeTestFile(t, path, "1,42000.5,0.01\n2,42001.0,0.02\n")
+
+	if err := tier.upload("btcusdt", "2024-01-15", path); err != nil {
+		t.Fatalf("upload with a non md5 ETag failed: %s", err)
+	}
+	if _, ok := bucket.objects["/archives/pendule/BTCUSDT/trades/2024-01-15.csv"]; !ok {
+		t.Fatal("file not uploaded under the prefixed key")
+	}
+
+	previousDays := Env.TIERING_LOCAL_DAYS
+	Env.TIERING_LOCAL_DAYS = 0
+	defer func() { Env.TIERING_LOCAL_DAYS = previousDays }()
+	if count, _ := tier.Evict(); count != 1 {
+		t.Fatalf("%d files evicted instead of 1", count)
+	}
+	if !tier.IsRemote(path) || !fileExists(path) {
+		t.Fatal("evicted file should be remote and still exist")
+	}
+
+	cleanup, err := fetchLocalFile(path)
+	if err != nil {
+		t.Fatalf("rehydration on access failed: %s", err)
+	}
+	cleanup()
+	data, err := os.ReadFile(path)
+	if err != nil || string(data) != "1,42000.5,0.01\n2,42001.0,0.02\n" {
+		t.Fatalf("rehydrated file differs: %q (%v)", data, err)
+	}
+	if tier.IsRemote(path) {
+		t.Fatal("rehydrated file should be local again")
+	}
+
+	// the index on disk tells the next process the file is local
+	reloaded := &tiering{entries: make(map[string]*TieringEntry)}
+	if err := reloaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if e := reloaded.entries[path]; e == nil || !e.Local || !e.Remote {
+		t.Fatalf("saved tiering entry %+v", e)
+	}
+}
+
+func TestTieringUploadSizeMismatch(t *testing.T) {
+	bucket := &fakeBucket{objects: make(map[string][]byte), truncate: 1}
+	tier := newTestTiering(t, bucket)
+
+	path := filepath.Join(pcommon.Env.ARCHIVES_DIR, "BTCUSDT", "trades", "2024-01-15.csv")
+	writeTestFile(t, path, "1,42000.5,0.01\n")
+
+	if err := tier.upload("btcusdt", "2024-01-15", path); err == nil {
+		t.Fatal("truncated upload should fail")
+	}
+	if tier.IsRemote(path) {
+		t.Fatal("failed upload should not be indexed")
+	}
+}
+
+func TestTieringUploadChecksMD5ETag(t *testing.T) {
+	bucket := &fakeBucket{objects: make(map[string][]byte), md5ETags: true}
+	tier := newTestTiering(t, bucket)
+
+	path := filepath.Join(pcommon.Env.ARCHIVES_DIR, "BTCUSDT", "trades", "2024-01-15.csv")
+	writeTestFile(t, path, "1,42000.5,0.01\n")
+	if err := tier.upload("btcusdt", "2024-01-15", path); err != nil {
+		t.Fatalf("upload with a matching md5 ETag failed: %s", err)
+	}
+
+	// same size, different content: only the md5 tells
+	bucket.objects = make(map[string][]byte)
+	tier.entries = make(map[string]*TieringEntry)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPut {
+			io.ReadAll(r.Body)
+			w.Header().Set("ETag", "\""+hex.EncodeToString(make([]byte, 16))+"\"")
+			return
+		}
+		bucket.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+	client, err := newS3Client(server.URL, "archives", "", "key", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tier.bucket.client = client
+	if err := tier.upload("btcusdt", "2024-01-15", path); err == nil {
+		t.Fatal("upload with a different md5 ETag should fail")
+	}
+	if tier.IsRemote(path) || tier.entries[path] != nil {
+		t.Fatal("failed upload should not be indexed")
+	}
+}
+
+func TestTieringUploadSSEKMS(t *testing.T) {
+	bucket := &fakeBucket{objects: make(map[string][]byte), encryption: "aws:kms"}
+	tier := newTestTiering(t, bucket)
+
+	path := filepath.Join(pcommon.Env.ARCHIVES_DIR, "BTCUSDT", "trades", "2024-01-15.csv")
+	writeTestFile(t, path, "1,42000.5,0.01\n")
+	if err := tier.upload("btcusdt", "2024-01-15", path); err != nil {
+		t.Fatalf("upload to an SSE-KMS bucket should only check the size: %s", err)
+	}
+
+	bucket.truncate = 1
+	tier.entries = make(map[string]*TieringEntry)
+	if err := tier.upload("btcusdt", "2024-01-15", path); err == nil {
+		t.Fatal("truncated upload to an SSE-KMS bucket should fail")
+	}
+}
@@ -0,0 +1,350 @@
+package engine
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pcommon "github.com/pendulea/pendule-common"
+	log "github.com/sirupsen/logrus"
+)
+
+type VerifyStatus string
+
+const (
+	VERIFY_OK VerifyStatus = "ok"
+	// the fragments do not match their manifest or their source archive
+	VERIFY_MISMATCH VerifyStatus = "mismatch"
+	// fragments without manifest, or offloaded to the bucket
+	VERIFY_UNVERIFIED VerifyStatus = "unverified"
+	VERIFY_ERROR      VerifyStatus = "error"
+)
+
+type VerifyResult struct {
+	SetID       string              `json:"set_id"`
+	ArchiveType pcommon.ArchiveType `json:"archive_type"`
+	Date        string              `json:"date"`
+	Status      VerifyStatus        `json:"status"`
+	// the raw archive was present and has been read again
+	SourceChecked bool     `json:"source_checked"`
+	Issues        []string `json:"issues,omitempty"`
+	Requeued      bool     `json:"requeued"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// VerifyQuery selects the archives to verify, empty fields are not filtered.
+type VerifyQuery struct {
+	SetID       string
+	ArchiveType pcommon.ArchiveType
+	// by default, from the first day of the history of the set until yesterday
+	From string
+	To   string
+	// fragment again (or download again if the source is absent or corrupted) the mismatching archives
+	Requeue bool
+}
+
+func findSetAsset(set *pcommon.SetJSON, t pcommon.AssetType) *pcommon.AssetJSON {
+	for i := range set.Assets {
+		if set.Assets[i].Address.AssetType == t {
+			return &set.Assets[i]
+		}
+	}
+	return nil
+}
+
+/*
+readFragment reads a fragment zip again, and returns its rows and time bounds.
+If asset is not nil, the values not formatted with the decimals of the asset are counted.
+*/
+func readFragment(fp string, asset *pcommon.AssetJSON) (*ManifestFragment, int, error) {
+	cleanup, err := fetchLocalFile(fp)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cleanup()
+	r, err := zip.OpenReader(fp)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	if len(r.File) != 1 {
+		return nil, 0, fmt.Errorf("invalid number of files: %d", len(r.File))
+	}
+	f, err := r.File[0].Open()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	if _, err := reader.Read(); err != nil && err != io.EOF {
+		return nil, 0, err
+	}
+	fragment := &ManifestFragment{}
+	badValues := 0
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(row) != 2 {
+			return nil, 0, fmt.Errorf("invalid row: %s", strings.Join(row, ","))
+		}
+		fragment.addRow(row[0])
+		if asset != nil {
+			if formatFragmentValue(row[1], asset) != row[1] {
+				badValues++
+			}
+		}
+	}
+	return fragment, badValues, nil
+}
+
+// sourceFragments reads the raw archive again, and returns the rows and time bounds the fragmenter builds for each asset.
+func sourceFragments(archivePath string, t pcommon.ArchiveType) (map[pcommon.AssetType]*ManifestFragment, error) {
+	csvPath := archivePath
+	if filepath.Ext(archivePath) == ".zip" {
+		tmp, err := os.MkdirTemp(filepath.Dir(archivePath), ".verify-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(tmp)
+		archiveDir := filepath.Join(tmp, "archive")
+		if err := extractArchiveCSV(archivePath, archiveDir); err != nil {
+			return nil, err
+		}
+		csvPath = archiveDir + ".csv"
+	}
+	lines, headerXY, err := ParseFromCSV(csvPath)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := pcommon.ArchivesIndex[t]
+	fragments := map[pcommon.AssetType]*ManifestFragment{}
+	for _, col := range tree.Columns {
+		fragments[col.Asset] = &ManifestFragment{Asset: col.Asset}
+	}
+	for _, line := range lines {
+		timeStr, err := branchValue(tree.Time, line, headerXY)
+		if err != nil {
+			return nil, err
+		}
+		for _, col := range tree.Columns {
+			value, err := branchValue(col, line, headerXY)
+			if err != nil {
+				return nil, err
+			}
+			if len(strings.TrimSpace(value)) > 0 {
+				fragments[col.Asset].addRow(strings.TrimSpace(timeStr))
+			}
+		}
+	}
+	return fragments, nil
+}
+
+func compareFragmentStats(what string, expected *ManifestFragment, got *ManifestFragment) []string {
+	issues := []string{}
+	if expected.Rows != got.Rows {
+		issues = append(issues, fmt.Sprintf("%s: %d rows instead of %d", what, got.Rows, expected.Rows))
+	}
+	if expected.MinTime != got.MinTime || expected.MaxTime != got.MaxTime {
+		issues = append(issues, fmt.Sprintf("%s: time bounds [%d, %d] instead of [%d, %d]", what, got.MinTime, got.MaxTime, expected.MinTime, expected.MaxTime))
+	}
+	return issues
+}
+
+/*
+verifyArchive checks the fragments of an archive against their manifest (hash, rows, time bounds, decimals formatting),
+and against the raw archive if it is still stored. It returns nil if the archive has not been fragmented.
+*/
+func verifyArchive(date string, set *pcommon.SetJSON, t pcommon.ArchiveType) *VerifyResult {
+	res := &VerifyResult{SetID: set.Settings.IDString(), ArchiveType: t, Date: date, Issues: []string{}}
+
+	manifest, err := ReadFragmentManifest(date, set.Settings, t)
+	if err != nil {
+		res.Status, res.Error = VERIFY_ERROR, err.Error()
+		return res
+	}
+	if manifest == nil {
+		for _, asset := range t.GetTargetedAssets() {
+			if fileExists(set.Settings.BuildArchiveFilePath(asset, date, "zip")) {
+				res.Status, res.Error = VERIFY_UNVERIFIED, "no manifest"
+				return res
+			}
+		}
+		return nil
+	}
+	for _, fp := range manifest.Paths() {
+		if Tiering.IsRemote(fp) {
+			res.Status, res.Error = VERIFY_UNVERIFIED, "offloaded to the bucket, rehydrate it first"
+			return res
+		}
+	}
+
+	for _, expected := range manifest.Fragments {
+		f, err := hashStoredFile(expected.Path)
+		if err != nil {
+			res.Issues = append(res.Issues, fmt.Sprintf("%s: %s", expected.Asset, err.Error()))
+			continue
+		}
+		if f.Size != expected.Size || f.SHA256 != expected.SHA256 {
+			res.Issues = append(res.Issues, fmt.Sprintf("%s: hash does not match the manifest", expected.Asset))
+		}
+		got, badValues, err := readFragment(expected.Path, findSetAsset(set, expected.Asset))
+		if err != nil {
+			res.Issues = append(res.Issues, fmt.Sprintf("%s: %s", expected.Asset, err.Error()))
+			continue
+		}
+		res.Issues = append(res.Issues, compareFragmentStats(string(expected.Asset), &expected, got)...)
+		if badValues > 0 {
+			res.Issues = append(res.Issues, fmt.Sprintf("%s: %d values not formatted with the asset decimals", expected.Asset, badValues))
+		}
+	}
+
+	archivePath := t.GetArchiveZipPath(date, set.Settings)
+	// an offloaded source is not rehydrated by the verification
+	sourceOffloaded := Tiering.IsRemote(archivePath)
+	if _, err := Output.Stat(archivePath); err == nil && !sourceOffloaded {
+		res.SourceChecked = true
+		cleanup, err := fetchLocalFile(archivePath)
+		if err != nil {
+			res.Status, res.Error = VERIFY_ERROR, err.Error()
+			return res
+		}
+		defer cleanup()
+		if source, err := hashFile(archivePath); err != nil {
+			res.Status, res.Error = VERIFY_ERROR, err.Error()
+			return res
+		} else if source.Size != manifest.Source.Size || source.SHA256 != manifest.Source.SHA256 {
+			res.Issues = append(res.Issues, "source: hash does not match the manifest")
+		}
+		fromSource, err := sourceFragments(archivePath, t)
+		if err != nil {
+			res.Issues = append(res.Issues, "source: "+err.Error())
+		}
+		for _, expected := range manifest.Fragments {
+			if got, ok := fromSource[expected.Asset]; ok {
+				res.Issues = append(res.Issues, compareFragmentStats(fmt.Sprintf("%s manifest", expected.Asset), got, &expected)...)
+			}
+		}
+	}
+
+	res.Status = VERIFY_OK
+	if len(res.Issues) > 0 {
+		res.Status = VERIFY_MISMATCH
+	} else if sourceOffloaded {
+		res.Status, res.Error = VERIFY_UNVERIFIED, "source offloaded to the bucket, rehydrate it first"
+	}
+	return res
+}
+
+/*
+requeueMismatch fragments again an archive whose fragments do not match, or downloads it again if its source
+is absent or does not match either. The archive is marked republished, so the parser ingests the fragments again.
+*/
+func (e *engine) requeueMismatch(set *pcommon.SetJSON, res *VerifyResult) error {
+	manifest, err := ReadFragmentManifest(res.Date, set.Settings, res.ArchiveType)
+	if err != nil {
+		return err
+	}
+	r := &RepublishedArchive{
+		SetID:       res.SetID,
+		ArchiveType: res.ArchiveType,
+		Date:        res.Date,
+		Assets:      res.ArchiveType.GetTargetedAssets(),
+		Reason:      "verification failed: " + res.Issues[0],
+		Previous:    manifest.Remote,
+	}
+	sourceValid := res.SourceChecked
+	for _, issue := range res.Issues {
+		sourceValid = sourceValid && !strings.HasPrefix(issue, "source")
+	}
+	if !sourceValid {
+		return e.refetchArchive(set, r)
+	}
+
+	r.DetectedAt = time.Now().UnixMilli()
+	if err := r.write(set.Settings); err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"set":    r.SetID,
+		"type":   r.ArchiveType,
+		"date":   r.Date,
+		"reason": r.Reason,
+	}).Warn("Fragments do not match, fragmenting the archive again")
+	// the fragmenter has likely run recently
+	Held.rerun(buildArchiveFragmenter(r.Date, set, r.ArchiveType))
+	return nil
+}
+
+/*
+Verify reads again the fragments (and the raw archives still stored) of the active sets over a date range,
+and reports the ones not matching their manifest or their source. With q.Requeue, the mismatching archives are
+fragmented or downloaded again.
+*/
+func (e *engine) Verify(q VerifyQuery) ([]VerifyResult, error) {
+	for _, date := range []string{q.From, q.To} {
+		if date == "" {
+			continue
+		}
+		if _, err := pcommon.Format.StrDateToDate(date); err != nil {
+			return nil, fmt.Errorf("invalid date: %s", date)
+		}
+	}
+
+	e.mu.RLock()
+	minTimeframe := e.minTimeframe
+	sets := make([]*pcommon.SetJSON, 0, len(e.activeSets))
+	for _, set := range e.activeSets {
+		if q.SetID == "" || set.Settings.IDString() == q.SetID {
+			sets = append(sets, set)
+		}
+	}
+	e.mu.RUnlock()
+
+	report := []VerifyResult{}
+	for _, set := range sets {
+		for _, t := range pcommon.ARCHIVE_TYPE_LIST {
+			if (q.ArchiveType != "" && t != q.ArchiveType) || !setUsesArchiveType(set, t) {
+				continue
+			}
+			from, to := q.From, q.To
+			if from == "" {
+				from = historyStart(set, t, minTimeframe)
+			}
+			if to == "" {
+				to = pcommon.Format.BuildDateStr(1)
+			}
+			if from == "" {
+				continue
+			}
+
+			start, _ := pcommon.Format.StrDateToDate(from)
+			for d := start; strings.Compare(pcommon.Format.FormatDateStr(d), to) <= 0 && !e.IsShuttingDown(); d = d.AddDate(0, 0, 1) {
+				res := verifyArchive(pcommon.Format.FormatDateStr(d), set, t)
+				if res == nil {
+					continue
+				}
+				if res.Status == VERIFY_MISMATCH && q.Requeue {
+					if err := e.requeueMismatch(set, res); err != nil {
+						res.Error = err.Error()
+					} else {
+						res.Requeued = true
+					}
+				}
+				report = append(report, *res)
+			}
+		}
+	}
+	return report, nil
+}
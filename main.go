@@ -4,7 +4,6 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/pendulea/pendule-archiver/engine"
 	pcommon "github.com/pendulea/pendule-common"
@@ -28,20 +27,34 @@ func initLogger() {
 }
 
 func cleanup() {
-	engine.Engine.Quit()
+	engine.Engine.Shutdown(engine.Env.SHUTDOWN_TIMEOUT)
 }
 
 func main() {
 	initLogger()
+	if len(os.Args) > 1 {
+		// keep stdout for the command output
+		log.SetOutput(os.Stderr)
+	}
 	pcommon.Env.Init()
-	engine.Engine.Init()
+	engine.Env.Init()
 
-	go func() {
-		for {
-			engine.Engine.RefreshSets()
-			time.Sleep(time.Minute)
-		}
-	}()
+	var provider engine.SetProvider = nil
+	if engine.Env.SETS_FILE != "" {
+		provider = engine.NewFileSetProvider(engine.Env.SETS_FILE)
+	}
+	engine.Engine.Init(provider)
+
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	if err := engine.Engine.Start(); err != nil {
+		log.Fatal(err)
+	}
+	go engine.Engine.RunRefreshLoop()
+	go runAdminServer()
 
 	sigs := make(chan os.Signal, 1)
 	// Create a channel to communicate that the signal has been handled
@@ -53,6 +66,11 @@ func main() {
 	// Start a goroutine that will handle the signals
 	go func() {
 		<-sigs // Block until a signal is received
+		go func() {
+			<-sigs // A second signal forces the exit
+			log.Warn("Forced exit")
+			os.Exit(1)
+		}()
 		cleanup()
 		done <- true // Signal that handling is complete
 	}()